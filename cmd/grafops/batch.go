@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/songrgg/grafops/pkg/grafana"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// NewBatchCommand creates `grafops batch` command, it runs the render jobs of the manifest.
+func NewBatchCommand(options *options) *cobra.Command {
+	var manifestPath string
+	cmd := &cobra.Command{
+		Use:   "batch",
+		Short: "render the dashboards of the jobs in the manifest",
+		Run: func(cmd *cobra.Command, args []string) {
+			if manifestPath == "" {
+				fmt.Println("manifest path can't be empty")
+				os.Exit(-1)
+			}
+			manifest := loadManifest(manifestPath)
+
+			dryRun := options.DryRun || options.Output != ""
+			if !dryRun && options.Host == "" {
+				fmt.Println("hosts can't be empty")
+				os.Exit(-1)
+			}
+			base, err := options.updateConfig(fileConfig{})
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+
+			fn := grafana.RenderDashboardsFromSource
+			if dryRun {
+				if options.Output != "" && options.Output != "-" {
+					if err := os.MkdirAll(options.Output, 0755); err != nil {
+						log.Fatalf("fail to create the output directory: %v", err)
+					}
+				}
+				fn = func(config grafana.UpdateConfig, source grafana.TemplateSource, vars grafana.RenderVars) error {
+					rendered, err := grafana.RenderTemplates(config, source, vars)
+					if err != nil {
+						return err
+					}
+					output := options.Output
+					if output != "" && output != "-" {
+						output = filepath.Join(output, config.Name)
+						if len(rendered) == 1 {
+							output += ".json"
+						}
+					}
+					return writeRendered(output, rendered)
+				}
+			}
+
+			failed := 0
+			for _, result := range grafana.RunManifest(base, manifest, fn) {
+				if result.Err != nil {
+					failed++
+					log.Printf("FAIL %s: %v", result.Job.Name, result.Err)
+					continue
+				}
+				log.Printf("OK   %s", result.Job.Name)
+			}
+			log.Printf("%d jobs, %d succeeded, %d failed", len(manifest.Jobs), len(manifest.Jobs)-failed, failed)
+			if failed > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&manifestPath, "manifest", "m", "",
+		"Yaml manifest file path, it lists the render jobs")
+	return cmd
+}
+
+// loadManifest loads the manifest, the template paths are relative to the manifest file.
+func loadManifest(manifestPath string) grafana.Manifest {
+	manifestBytes, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		log.Fatalf("Manifest file doesn't exist")
+	}
+
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewBuffer(manifestBytes)); err != nil {
+		log.Fatalf("Failed to read manifest file: %v", err)
+	}
+	var manifest grafana.Manifest
+	if err := v.Unmarshal(&manifest); err != nil {
+		fmt.Println("fail to load manifest file: ", err)
+		os.Exit(-1)
+	}
+	if err := manifest.Validate(); err != nil {
+		fmt.Println("invalid manifest file: ", err)
+		os.Exit(-1)
+	}
+
+	for i, job := range manifest.Jobs {
+		if job.Template != "" && !filepath.IsAbs(job.Template) {
+			manifest.Jobs[i].Template = filepath.Join(filepath.Dir(manifestPath), job.Template)
+		}
+	}
+	return manifest
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/songrgg/grafops/pkg/grafana"
+	"github.com/spf13/cobra"
+)
+
+const diffCommandName = "diff"
+
+// NewDiffCommand creates `grafops diff` command, it compares the rendered dashboards with the deployed ones.
+// The exit code is 0 if there is no drift, 1 if there is, and 2 if the diff fails or its usage is wrong.
+func NewDiffCommand(options *options) *cobra.Command {
+	var templatePath string
+	cmd := &cobra.Command{
+		Use:   diffCommandName,
+		Short: "diff the rendered dashboards and the dashboards deployed in Grafana",
+		Run: func(cmd *cobra.Command, args []string) {
+			if options.Host == "" {
+				fmt.Println("hosts can't be empty")
+				os.Exit(2)
+			}
+			if templatePath == "" && options.DashboardUID == "" {
+				fmt.Println("either template path or template UID is needed")
+				os.Exit(2)
+			}
+			if options.ConfigPath == "" {
+				fmt.Println("config path can't be empty")
+				os.Exit(2)
+			}
+			vars, config, err := options.load()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(2)
+			}
+
+			var source grafana.TemplateSource
+			if templatePath != "" {
+				source = grafana.NewFileTemplateSource(templatePath)
+			} else {
+				grafcli, err := grafana.NewTemplateClient(config)
+				if err != nil {
+					log.Printf("fail to create the Grafana client: %v", err)
+					os.Exit(2)
+				}
+				source = grafana.NewAPITemplateSource(grafcli, config.DashboardUID)
+			}
+
+			diffs, err := grafana.DiffRenderedDashboards(config, source, vars)
+			if err != nil {
+				log.Printf("fail to diff the Grafana dashboard: %v", err)
+				os.Exit(2)
+			}
+
+			drift := false
+			for _, d := range diffs {
+				switch {
+				case !d.Deployed:
+					drift = true
+					fmt.Printf("--- %s (%s) isn't deployed\n", d.Rendered.UID, d.Rendered.Name)
+				case !d.Diff.Empty():
+					drift = true
+					fmt.Printf("--- %s (%s)\n%s", d.Rendered.UID, d.Rendered.Name, d.Diff)
+				}
+			}
+			if drift {
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringVarP(&templatePath, "template", "t", "",
+		"The JSON file of the template dashboard, or the directory of the JSON files, "+
+			"the template is fetched from Grafana by the template UID if it's empty")
+	return cmd
+}
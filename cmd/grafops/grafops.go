@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/songrgg/grafops/pkg/grafana"
 	"github.com/spf13/cobra"
@@ -14,16 +17,57 @@ import (
 
 func main() {
 	rootCmd := NewGrafOpsCommand()
-	if err := rootCmd.Execute(); err != nil {
+	if cmd, err := rootCmd.ExecuteC(); err != nil {
 		fmt.Println("fail to run the grafops: ", err)
+		os.Exit(errorExitCode(cmd))
 	}
 }
 
+// errorExitCode returns the exit code of the command failing on the usage, e.g. an unknown flag,
+// it's 2 for the diff command whose exit code 1 tells the drift.
+func errorExitCode(cmd *cobra.Command) int {
+	if cmd.Name() == diffCommandName {
+		return 2
+	}
+	return 1
+}
+
 type options struct {
 	Host         string `json:"host"`
 	DashboardUID string `json:"dashboardUID"`
 	BasicAuth    string `json:"basicAuth"`
 	ConfigPath   string `json:"configPath"`
+	Name         string `json:"name"`
+	RenderedUID  string `json:"renderedUID"`
+	Title        string `json:"title"`
+	// Token, TokenFile, Username and Password are the credentials of Grafana, only one of them or BasicAuth is used.
+	Token     string `json:"token"`
+	TokenFile string `json:"tokenFile"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+	// CAFile, CertFile, KeyFile, InsecureSkipVerify, Proxy, Timeout and Headers are how to connect to Grafana.
+	CAFile             string        `json:"caFile"`
+	CertFile           string        `json:"certFile"`
+	KeyFile            string        `json:"keyFile"`
+	InsecureSkipVerify bool          `json:"insecureSkipVerify"`
+	Proxy              string        `json:"proxy"`
+	Timeout            time.Duration `json:"timeout"`
+	Headers            []string      `json:"headers"`
+	// OrgID or OrgName is the org the dashboards are rendered to, TemplateOrgID or TemplateOrgName is the org of
+	// the template dashboard.
+	OrgID           int    `json:"orgID"`
+	OrgName         string `json:"orgName"`
+	TemplateOrgID   int    `json:"templateOrgID"`
+	TemplateOrgName string `json:"templateOrgName"`
+	// FolderUID or FolderTitle is the folder of the rendered dashboards, CreateFolder creates it if it doesn't exist.
+	FolderUID    string `json:"folderUID"`
+	FolderTitle  string `json:"folderTitle"`
+	CreateFolder bool   `json:"createFolder"`
+	// FailOnManualEdit fails instead of overwriting the rendered dashboard edited by hand.
+	FailOnManualEdit bool `json:"failOnManualEdit"`
+	// DryRun writes the rendered dashboard to the Output instead of saving it.
+	DryRun bool   `json:"dryRun"`
+	Output string `json:"output"`
 }
 
 func (o *options) validate() {
@@ -36,45 +80,131 @@ func (o *options) validate() {
 		fmt.Println("template UID can't be empty")
 		os.Exit(-1)
 	}
+}
 
-	if o.ConfigPath == "" {
-		fmt.Println("config path can't be empty")
+// checkMissingVars exits if some variables of the templates have no defaults, it's checked when the config path
+// is empty, the templates whose variables all have defaults are rendered without the configuration file.
+func checkMissingVars(source grafana.TemplateSource) {
+	missing, err := grafana.MissingTemplateVars(source, nil)
+	if err != nil {
+		log.Fatalf("fail to read the templates: %v", err)
+	}
+	if len(missing) > 0 {
+		fmt.Println("config path can't be empty, the variables without defaults need values:")
+		for source, names := range missing {
+			fmt.Printf("  %s: %s\n", source, strings.Join(names, ", "))
+		}
 		os.Exit(-1)
 	}
 }
 
+// envPrefix is the prefix of the environment variables of the options, e.g. GRAFOPS_TOKEN for --token.
+const envPrefix = "GRAFOPS_"
+
+// loadEnv sets the options which aren't given by the flags from the environment variables,
+// so the credentials can be kept out of the shell history. The credentials of the flags win, the ones of
+// the environment variables are used only if no flag gives the credentials, except the password of --username.
+func (o *options) loadEnv() {
+	values := map[string]*string{"HOST": &o.Host}
+	if o.Token == "" && o.TokenFile == "" && o.Username == "" && o.BasicAuth == "" {
+		values["BASIC_AUTH"] = &o.BasicAuth
+		values["TOKEN"] = &o.Token
+		values["TOKEN_FILE"] = &o.TokenFile
+		values["USERNAME"] = &o.Username
+	}
+	for name, value := range values {
+		if *value == "" {
+			*value = os.Getenv(envPrefix + name)
+		}
+	}
+	if o.Username != "" && o.Password == "" {
+		o.Password = os.Getenv(envPrefix + "PASSWORD")
+	}
+}
+
+// auth returns the credentials of Grafana given by the options.
+func (o *options) auth() (grafana.Auth, error) {
+	given := 0
+	for _, value := range []string{o.Token, o.TokenFile, o.Username, o.BasicAuth} {
+		if value != "" {
+			given++
+		}
+	}
+	if given > 1 {
+		return grafana.Auth{}, errors.New("only one of --token, --token_file, --username and --basic_auth can be given")
+	}
+	if o.Password != "" && o.Username == "" {
+		return grafana.Auth{}, errors.New("--password is given without --username")
+	}
+
+	if o.TokenFile != "" {
+		token, err := ioutil.ReadFile(o.TokenFile)
+		if err != nil {
+			return grafana.Auth{}, fmt.Errorf("fail to read the token file: %w", err)
+		}
+		if len(bytes.TrimSpace(token)) == 0 {
+			return grafana.Auth{}, fmt.Errorf("the token file %s is empty", o.TokenFile)
+		}
+		return grafana.Auth{Token: string(bytes.TrimSpace(token))}, nil
+	}
+	return grafana.Auth{Token: o.Token, Username: o.Username, Password: o.Password}, nil
+}
+
+// http returns how to connect to Grafana given by the options.
+func (o *options) http() (grafana.HTTPConfig, error) {
+	headers := make(map[string]string, len(o.Headers))
+	for _, header := range o.Headers {
+		parts := strings.SplitN(header, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return grafana.HTTPConfig{}, fmt.Errorf("invalid header %q, it should be `Name: value`", header)
+		}
+		headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return grafana.HTTPConfig{
+		CAFile:             o.CAFile,
+		CertFile:           o.CertFile,
+		KeyFile:            o.KeyFile,
+		InsecureSkipVerify: o.InsecureSkipVerify,
+		ProxyURL:           o.Proxy,
+		Timeout:            o.Timeout,
+		Headers:            headers,
+	}, nil
+}
+
 // NewGrafOpsCommand creates `grafops` command.
 func NewGrafOpsCommand() *cobra.Command {
 	options := options{}
 	cmds := &cobra.Command{
 		Use:   "grafops",
 		Short: "grafops manages the Grafana dashboards",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			options.loadEnv()
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			options.validate()
-
-			configBytes, err := ioutil.ReadFile(options.ConfigPath)
+			vars, config, err := options.load()
 			if err != nil {
-				log.Fatalf("Configuration file doesn't exist")
+				log.Fatalf("%v", err)
 			}
-
-			viper.SetConfigType("yaml")
-			err = viper.ReadConfig(bytes.NewBuffer(configBytes))
-			if err != nil {
-				log.Fatalf("Failed to read configuration file: %v", err)
+			if options.ConfigPath == "" {
+				grafcli, err := grafana.NewTemplateClient(config)
+				if err != nil {
+					log.Fatalf("fail to create the Grafana client: %v", err)
+				}
+				checkMissingVars(grafana.NewAPITemplateSource(grafcli, config.DashboardUID))
 			}
-
-			var vars grafana.RenderVars
-			err = viper.UnmarshalKey("vars", &vars)
-			if err != nil {
-				fmt.Println("fail to load config file: ", err)
-				os.Exit(-1)
+			if options.DryRun || options.Output != "" {
+				rendered, err := grafana.RenderDashboardDryRun(config, vars)
+				if err != nil {
+					log.Fatalf("fail to render the Grafana dashboard: %v", err)
+				}
+				if err := writeRendered(options.Output, rendered); err != nil {
+					log.Fatalf("fail to write the rendered dashboard: %v", err)
+				}
+				return
 			}
 
-			err = grafana.RenderDashboardWithTemplate(grafana.UpdateConfig{
-				APIUrl:       options.Host,
-				DashboardUID: options.DashboardUID,
-				BasicAuth:    options.BasicAuth,
-			}, vars)
+			err = grafana.RenderDashboardWithTemplate(config, vars)
 			if err != nil {
 				log.Fatalf("fail to render the Grafana dashboard: %v", err)
 			}
@@ -87,9 +217,150 @@ func NewGrafOpsCommand() *cobra.Command {
 		"The UID of the template dashboard in Grafana, it could be in the URL of Grafana dashboard, for example,"+
 			"http://localhost:3000/d/RKAQZi9Zk/service-monitoring, the UID is `RKAQZi9Zk`")
 	cmds.PersistentFlags().StringVar(&options.BasicAuth, "basic_auth", "",
-		"Basic auth for the Grafana API")
+		"Basic auth `user:password` or an API key for the Grafana API, prefer --username/--password or --token")
+	cmds.PersistentFlags().StringVar(&options.Token, "token", "",
+		"The API key or the service account token for the Grafana API, or GRAFOPS_TOKEN")
+	cmds.PersistentFlags().StringVar(&options.TokenFile, "token_file", "",
+		"The file of the API key or the service account token for the Grafana API, or GRAFOPS_TOKEN_FILE")
+	cmds.PersistentFlags().StringVar(&options.Username, "username", "",
+		"The username of the basic auth for the Grafana API, or GRAFOPS_USERNAME")
+	cmds.PersistentFlags().StringVar(&options.Password, "password", "",
+		"The password of the basic auth for the Grafana API, or GRAFOPS_PASSWORD")
+	cmds.PersistentFlags().StringVar(&options.FolderUID, "folder_uid", "",
+		"The UID of the folder of the rendered dashboards, it defaults to the folder of the template")
+	cmds.PersistentFlags().StringVar(&options.FolderTitle, "folder", "",
+		"The title of the folder of the rendered dashboards, or the path like `Teams/News` of a nested folder")
+	cmds.PersistentFlags().BoolVar(&options.CreateFolder, "create_folder", false,
+		"Create the folder of the rendered dashboards if it doesn't exist")
+	cmds.PersistentFlags().IntVar(&options.OrgID, "org_id", 0,
+		"The ID of the Grafana org the dashboards are rendered to, it defaults to the org of the credentials")
+	cmds.PersistentFlags().StringVar(&options.OrgName, "org", "",
+		"The name of the Grafana org the dashboards are rendered to, instead of --org_id")
+	cmds.PersistentFlags().IntVar(&options.TemplateOrgID, "template_org_id", 0,
+		"The ID of the Grafana org of the template dashboard, it defaults to the org the dashboards are rendered to")
+	cmds.PersistentFlags().StringVar(&options.TemplateOrgName, "template_org", "",
+		"The name of the Grafana org of the template dashboard, instead of --template_org_id")
+	cmds.PersistentFlags().StringVar(&options.CAFile, "ca_file", "",
+		"The PEM bundle of the CAs verifying the certificate of Grafana, besides the system CAs")
+	cmds.PersistentFlags().StringVar(&options.CertFile, "client_cert", "",
+		"The PEM client certificate for mTLS with Grafana")
+	cmds.PersistentFlags().StringVar(&options.KeyFile, "client_key", "",
+		"The PEM key of the client certificate for mTLS with Grafana")
+	cmds.PersistentFlags().BoolVar(&options.InsecureSkipVerify, "insecure_skip_verify", false,
+		"Skip verifying the certificate of Grafana")
+	cmds.PersistentFlags().StringVar(&options.Proxy, "proxy", "",
+		"The HTTP proxy to Grafana, it defaults to HTTPS_PROXY or HTTP_PROXY")
+	cmds.PersistentFlags().DurationVar(&options.Timeout, "timeout", 30*time.Second,
+		"The time limit of a request to Grafana, 0 means no limit")
+	cmds.PersistentFlags().StringArrayVar(&options.Headers, "header", nil,
+		"An extra header `Name: value` of the requests to Grafana, e.g. for an auth proxy, it can be repeated")
 	cmds.PersistentFlags().StringVarP(&options.ConfigPath, "config_path", "c", "",
 		"Yaml configuration file path")
+	cmds.PersistentFlags().StringVar(&options.Name, "name", "",
+		"The name of the rendered dashboard, the dashboards rendered from the same template with different names "+
+			"have different UIDs")
+	cmds.PersistentFlags().StringVar(&options.RenderedUID, "rendered_uid", "",
+		"The UID of the rendered dashboard, it's derived from the template UID and the name by default")
+	cmds.PersistentFlags().StringVar(&options.Title, "title", "",
+		"The title of the rendered dashboard, a pattern like `{{.Title}} ({{.Name}})` of the rendered title, the name, "+
+			"the template UID and the vars")
+	cmds.PersistentFlags().BoolVar(&options.FailOnManualEdit, "fail_on_manual_edit", false,
+		"Fail instead of overwriting the rendered dashboard if it was edited by hand")
+	cmds.PersistentFlags().BoolVar(&options.DryRun, "dry_run", false,
+		"Write the rendered dashboard to the output instead of saving it in Grafana")
+	cmds.PersistentFlags().StringVarP(&options.Output, "output", "o", "",
+		"The file the rendered dashboard is written to, `-` for stdout, it implies --dry_run")
 
+	cmds.AddCommand(NewRenderCommand(&options))
+	cmds.AddCommand(NewDiffCommand(&options))
+	cmds.AddCommand(NewBatchCommand(&options))
 	return cmds
 }
+
+// fileConfig is the configuration file of the variables and how the dashboards are rendered.
+type fileConfig struct {
+	Vars       grafana.RenderVars
+	Render     grafana.RenderOptions
+	AlertRules grafana.AlertRulesConfig
+	FanOut     grafana.FanOutConfig
+	// FolderPermissions replace the permissions of the folder of the rendered dashboards.
+	FolderPermissions []grafana.FolderPermission
+}
+
+// loadConfig loads the variables, the render options, the alert rules, the fan-out and the folder permissions
+// from the configuration file.
+func loadConfig(configPath string) (fileConfig, error) {
+	configBytes, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("configuration file doesn't exist: %w", err)
+	}
+
+	viper.SetConfigType("yaml")
+	err = viper.ReadConfig(bytes.NewBuffer(configBytes))
+	if err != nil {
+		return fileConfig{}, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	var config fileConfig
+	for key, out := range map[string]interface{}{
+		"vars":              &config.Vars,
+		"render":            &config.Render,
+		"alertRules":        &config.AlertRules,
+		"fanOut":            &config.FanOut,
+		"folderPermissions": &config.FolderPermissions,
+	} {
+		err = viper.UnmarshalKey(key, out)
+		if err != nil {
+			return fileConfig{}, fmt.Errorf("fail to load config file: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// load loads the configuration file, and returns the vars in it and the config to render the dashboards,
+// there are no vars without the configuration file.
+func (o *options) load() (grafana.RenderVars, grafana.UpdateConfig, error) {
+	var (
+		fileConfig fileConfig
+		err        error
+	)
+	if o.ConfigPath != "" {
+		if fileConfig, err = loadConfig(o.ConfigPath); err != nil {
+			return nil, grafana.UpdateConfig{}, err
+		}
+	}
+	config, err := o.updateConfig(fileConfig)
+	return fileConfig.Vars, config, err
+}
+
+// updateConfig returns the config to render the dashboards with the command line options.
+func (o *options) updateConfig(config fileConfig) (grafana.UpdateConfig, error) {
+	auth, err := o.auth()
+	if err != nil {
+		return grafana.UpdateConfig{}, err
+	}
+	http, err := o.http()
+	if err != nil {
+		return grafana.UpdateConfig{}, err
+	}
+	return grafana.UpdateConfig{
+		APIUrl:            o.Host,
+		DashboardUID:      o.DashboardUID,
+		BasicAuth:         o.BasicAuth,
+		Auth:              auth,
+		HTTP:              http,
+		Org:               grafana.Org{ID: o.OrgID, Name: o.OrgName},
+		TemplateOrg:       grafana.Org{ID: o.TemplateOrgID, Name: o.TemplateOrgName},
+		Name:              o.Name,
+		RenderedUID:       o.RenderedUID,
+		Title:             o.Title,
+		FailOnManualEdit:  o.FailOnManualEdit,
+		RenderOptions:     config.Render,
+		AlertRules:        config.AlertRules,
+		FanOut:            config.FanOut,
+		FolderUID:         o.FolderUID,
+		FolderTitle:       o.FolderTitle,
+		CreateFolder:      o.CreateFolder,
+		FolderPermissions: config.FolderPermissions,
+	}, nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/songrgg/grafops/pkg/grafana"
+	"github.com/spf13/cobra"
+)
+
+// NewRenderCommand creates `grafops render` command, it renders the template dashboards from the local files.
+func NewRenderCommand(options *options) *cobra.Command {
+	var templatePath string
+	cmd := &cobra.Command{
+		Use:   "render",
+		Short: "render the template dashboards from the JSON file or the directory of JSON files",
+		Run: func(cmd *cobra.Command, args []string) {
+			if templatePath == "" {
+				fmt.Println("template path can't be empty")
+				os.Exit(-1)
+			}
+			source := grafana.NewFileTemplateSource(templatePath)
+			if options.ConfigPath == "" {
+				checkMissingVars(source)
+			}
+			vars, config, err := options.load()
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+
+			// it's rendered offline unless the rendered dashboards are pushed to Grafana
+			if options.Host == "" || options.DryRun || options.Output != "" {
+				rendered, err := grafana.RenderTemplates(config, source, vars)
+				if err != nil {
+					log.Fatalf("fail to render the Grafana dashboard: %v", err)
+				}
+				if err := writeRendered(options.Output, rendered); err != nil {
+					log.Fatalf("fail to write the rendered dashboard: %v", err)
+				}
+				return
+			}
+
+			err = grafana.RenderDashboardsFromSource(config, source, vars)
+			if err != nil {
+				log.Fatalf("fail to render the Grafana dashboard: %v", err)
+			}
+			log.Println("Render the dashboard successfully")
+		},
+	}
+
+	cmd.Flags().StringVarP(&templatePath, "template", "t", "",
+		"The JSON file of the template dashboard, or the directory of the JSON files")
+	return cmd
+}
+
+// writeRendered writes the rendered dashboards to the output, the output is a directory if there are several
+// dashboards, and every dashboard is written to the file named after it.
+func writeRendered(output string, rendered []grafana.RenderedDashboard) error {
+	if len(rendered) == 1 || output == "" || output == "-" {
+		for _, r := range rendered {
+			if err := writeOutput(output, r.Dashboard); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return err
+	}
+	for _, r := range rendered {
+		if err := writeOutput(filepath.Join(output, r.Name+".json"), r.Dashboard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOutput writes the pretty-printed dashboard JSON to the file, or to stdout if the file is empty or `-`.
+func writeOutput(file string, dashboard []byte) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, dashboard, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+
+	if file == "" || file == "-" {
+		_, err := os.Stdout.Write(out.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(file, out.Bytes(), 0644)
+}
@@ -0,0 +1,120 @@
+package grafana
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+// renderAlert renders the legacy alert of the panel copied from the template panel. The alert names of the
+// repeated panels get the suffix unless they refer to all the repeat variables, so that every copy has its own name.
+func (r *renderer) renderAlert(panel map[string]interface{}, tmpl map[string]interface{}, scope renderScope) {
+	alert, ok := panel["alert"].(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	// the tag names could be variables as well
+	if tags, ok := alert["alertRuleTags"].(map[string]interface{}); ok {
+		renderedTags := make(map[string]interface{}, len(tags))
+		for k, v := range tags {
+			renderedTags[interpolate(k, scope.vars, "")] = v
+		}
+		alert["alertRuleTags"] = renderedTags
+	}
+
+	tmplName := simplejson.NewFromAny(tmpl).GetPath("alert", "name").MustString()
+	missing := unreferenced(tmplName, scope.repeats)
+	if len(missing) == 0 {
+		return
+	}
+	name, _ := alert["name"].(string)
+	alert["name"] = name + interpolate(r.alertNameSuffix(missing), scope.vars, "")
+}
+
+// unreferenced returns the variables the text doesn't refer to.
+func unreferenced(text string, names []string) []string {
+	referred := make(map[string]bool)
+	for _, ref := range scanVariables(text) {
+		referred[ref.name] = true
+	}
+	var missing []string
+	for _, name := range names {
+		if !referred[name] {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+// alertNameSuffix returns the template of the alert name suffix, it defaults to the values of
+// the repeat variables the name doesn't refer to in parentheses, e.g. ` (news, prod)`.
+func (r *renderer) alertNameSuffix(missing []string) string {
+	if r.options.AlertNameSuffix != "" {
+		return r.options.AlertNameSuffix
+	}
+	refs := make([]string, len(missing))
+	for i, repeat := range missing {
+		refs[i] = "${" + repeat + "}"
+	}
+	return " (" + strings.Join(refs, ", ") + ")"
+}
+
+// validateAlerts checks that the copies of a repeated panel have their own alert names, and that the alert
+// conditions refer to the queries of their panels which use no template variables, because Grafana alerts
+// don't support template variables. The panels which aren't repeated keep the alert names of the template.
+func (r *renderer) validateAlerts(panels []map[string]interface{}) error {
+	// the copies of a repeated panel have the template ID and the names of the repeat variables in common
+	names := make(map[string]map[string]bool)
+	for _, panel := range panels {
+		alert, ok := panel["alert"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		name, _ := alert["name"].(string)
+		if c, ok := r.copyOf(panel); ok && len(c.scope.repeats) > 0 {
+			tmpl := fmt.Sprint(c.templateID, c.scope.repeats)
+			if names[tmpl][name] {
+				return fmt.Errorf("alert name %q is used by more than one copy of the repeated panel", name)
+			}
+			if names[tmpl] == nil {
+				names[tmpl] = make(map[string]bool)
+			}
+			names[tmpl][name] = true
+		}
+
+		targets := make(map[string]interface{})
+		for _, target := range simplejson.NewFromAny(panel).Get("targets").MustArray() {
+			refID, _ := simplejson.NewFromAny(target).Get("refId").String()
+			targets[refID] = target
+		}
+
+		for _, condition := range simplejson.NewFromAny(alert).Get("conditions").MustArray() {
+			refID, _ := simplejson.NewFromAny(condition).GetPath("query", "params").GetIndex(0).String()
+			target, ok := targets[refID]
+			if !ok {
+				return fmt.Errorf("alert %q refers to the query %q which doesn't exist in the panel", name, refID)
+			}
+			if varName, ok := r.templateVariableIn(target); ok {
+				return fmt.Errorf("query %q of alert %q uses the template variable $%s", refID, name, varName)
+			}
+		}
+	}
+	return nil
+}
+
+// templateVariableIn returns the name of a template variable the JSON value still refers to.
+func (r *renderer) templateVariableIn(v interface{}) (string, bool) {
+	var found string
+	renderStrings(v, nil, func(s string, _ string) string {
+		for _, ref := range scanVariables(s) {
+			if _, ok := r.templates[ref.name]; ok && found == "" {
+				found = ref.name
+			}
+		}
+		return s
+	})
+	return found, found != ""
+}
@@ -0,0 +1,149 @@
+package grafana
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+const alertDashboard = `{"panels": [
+  {"type": "graph", "title": "$SERVICE_NAME latency", "repeat": "SERVICE_NAME", "repeatDirection": "v",
+   "gridPos": {"h": 8, "w": 24, "x": 0, "y": 0},
+   "targets": [{"expr": "latency{service=\"$SERVICE_NAME\"}", "refId": "A"}],
+   "alert": {
+     "name": %s,
+     "message": "$SERVICE_NAME is slow",
+     "alertRuleTags": {"service": "$SERVICE_NAME", "$TEAM": "owner"},
+     "conditions": [{"query": {"params": [%s, "5m", "now"]}, "type": "query"}]
+   }}
+],
+"templating": {"list": [{"name": "SERVICE_NAME"}, {"name": "ENV"}]}}`
+
+var alertVars = RenderVars{
+	{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}},
+	{Name: "TEAM", Values: []Val{{Value: "core"}}},
+}
+
+func renderAlerts(t *testing.T, name string, refID string, options RenderOptions) []*simplejson.Json {
+	dashboard := sprintfJSON(alertDashboard, name, refID)
+	rendered, err := RenderDashboardWithOptions([]byte(dashboard), alertVars, options)
+	assert.Nil(t, err)
+
+	j, err := simplejson.NewJson(rendered)
+	assert.Nil(t, err)
+	var alerts []*simplejson.Json
+	for i := range j.Get("panels").MustArray() {
+		alerts = append(alerts, j.Get("panels").GetIndex(i).Get("alert"))
+	}
+	return alerts
+}
+
+func TestRenderAlert(t *testing.T) {
+	alerts := renderAlerts(t, "$SERVICE_NAME latency", "A", RenderOptions{})
+	assert.Len(t, alerts, 2)
+	assert.Equal(t, "news latency", alerts[0].Get("name").MustString())
+	assert.Equal(t, "payment latency", alerts[1].Get("name").MustString())
+	assert.Equal(t, "payment is slow", alerts[1].Get("message").MustString())
+	assert.Equal(t, map[string]interface{}{"service": "payment", "core": "owner"},
+		alerts[1].Get("alertRuleTags").MustMap())
+}
+
+func TestRenderAlertNameSuffix(t *testing.T) {
+	alerts := renderAlerts(t, "High latency", "A", RenderOptions{})
+	assert.Equal(t, "High latency (news)", alerts[0].Get("name").MustString())
+	assert.Equal(t, "High latency (payment)", alerts[1].Get("name").MustString())
+
+	alerts = renderAlerts(t, "High latency", "A", RenderOptions{AlertNameSuffix: " - ${SERVICE_NAME} of $TEAM"})
+	assert.Equal(t, "High latency - news of core", alerts[0].Get("name").MustString())
+	assert.Equal(t, "High latency - payment of core", alerts[1].Get("name").MustString())
+}
+
+// nestedAlertDashboard has a panel repeated by SERVICE_NAME in a row repeated by REGION.
+const nestedAlertDashboard = `{"panels": [
+  {"type": "row", "id": 1, "title": "$REGION", "repeat": "REGION", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "timeseries", "id": 2, "title": "$SERVICE_NAME latency", "repeat": "SERVICE_NAME", "repeatDirection": "v",
+   "gridPos": {"h": 8, "w": 24, "x": 0, "y": 1},
+   "datasource": {"type": "prometheus", "uid": "prom"},
+   "targets": [{"expr": "latency{service=\"$SERVICE_NAME\", region=\"$REGION\"}", "refId": "A"}],
+   "alert": {"name": %s, "conditions": [{"query": {"params": ["A", "5m", "now"]}, "type": "query"}]}}
+],
+"templating": {"list": [{"name": "REGION"}, {"name": "SERVICE_NAME"}]}}`
+
+var nestedAlertVars = RenderVars{
+	{Name: "REGION", Values: []Val{{Value: "eu"}, {Value: "us"}}},
+	{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}},
+}
+
+func TestRenderAlertNameSuffixNestedRepeat(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected []string
+	}{
+		{"High latency in $REGION", []string{
+			"High latency in eu (news)", "High latency in eu (payment)",
+			"High latency in us (news)", "High latency in us (payment)",
+		}},
+		{"High latency", []string{
+			"High latency (eu, news)", "High latency (eu, payment)",
+			"High latency (us, news)", "High latency (us, payment)",
+		}},
+		{"$SERVICE_NAME latency in $REGION", []string{
+			"news latency in eu", "payment latency in eu", "news latency in us", "payment latency in us",
+		}},
+	}
+	for _, tt := range tests {
+		rendered, err := RenderDashboard([]byte(sprintfJSON(nestedAlertDashboard, tt.name)), nestedAlertVars)
+		assert.Nil(t, err, tt.name)
+
+		j, err := simplejson.NewJson(rendered)
+		assert.Nil(t, err)
+		var names []string
+		for i := range j.Get("panels").MustArray() {
+			if name, err := j.Get("panels").GetIndex(i).GetPath("alert", "name").String(); err == nil {
+				names = append(names, name)
+			}
+		}
+		assert.Equal(t, tt.expected, names, tt.name)
+	}
+}
+
+func TestValidateAlerts(t *testing.T) {
+	dashboard := sprintfJSON(alertDashboard, "High latency", "B")
+	_, err := RenderDashboard([]byte(dashboard), alertVars)
+	assert.EqualError(t, err, `alert "High latency (news)" refers to the query "B" which doesn't exist in the panel`)
+
+	// the template variable ENV isn't rendered
+	dashboard = `{"panels": [
+  {"type": "graph", "title": "latency", "gridPos": {"h": 8, "w": 24, "x": 0, "y": 0},
+   "targets": [{"expr": "latency{env=\"$ENV\"}", "refId": "A"}],
+   "alert": {"name": "High latency", "conditions": [{"query": {"params": ["A", "5m", "now"]}}]}}
+],
+"templating": {"list": [{"name": "ENV"}]}}`
+	_, err = RenderDashboard([]byte(dashboard), alertVars)
+	assert.EqualError(t, err, `query "A" of alert "High latency" uses the template variable $ENV`)
+
+	// two template panels can share the alert name like in Grafana
+	dashboard = `{"panels": [
+  {"type": "graph", "title": "a", "alert": {"name": "High latency"}},
+  {"type": "graph", "title": "b", "alert": {"name": "High latency"}}
+]}`
+	_, err = RenderDashboard([]byte(dashboard), alertVars)
+	assert.Nil(t, err)
+
+	// but the copies of a repeated panel can't
+	dashboard = sprintfJSON(alertDashboard, "High latency", "A")
+	_, err = RenderDashboardWithOptions([]byte(dashboard), alertVars, RenderOptions{AlertNameSuffix: " of $TEAM"})
+	assert.EqualError(t, err, `alert name "High latency of core" is used by more than one copy of the repeated panel`)
+}
+
+// sprintfJSON formats the JSON template with the string arguments quoted.
+func sprintfJSON(format string, args ...string) string {
+	quoted := make([]interface{}, len(args))
+	for i, arg := range args {
+		quoted[i] = strconv.Quote(arg)
+	}
+	return fmt.Sprintf(format, quoted...)
+}
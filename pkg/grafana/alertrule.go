@@ -0,0 +1,388 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+	"gopkg.in/yaml.v2"
+)
+
+// AlertRulesConfig is the config of the Grafana unified alert rules rendered for the rendered dashboard.
+type AlertRulesConfig struct {
+	// FolderUID is the folder of the rule group when it's pushed through the API.
+	FolderUID string `json:"folderUID"`
+	// Folder is the folder title of the rule group in the file provisioning.
+	Folder string `json:"folder"`
+	// Group is the name of the rule group.
+	Group string `json:"group"`
+	// Interval is the evaluation interval of the rule group, e.g. `1m`, it defaults to one minute.
+	Interval string `json:"interval"`
+	// OrgID is the organization of the rule group in the file provisioning, it defaults to 1.
+	OrgID int64 `json:"orgId"`
+	// File writes the rule group as a file provisioning YAML instead of pushing it through the API.
+	File  string              `json:"file"`
+	Rules []AlertRuleTemplate `json:"rules"`
+}
+
+// AlertRuleTemplate is the template of the unified alert rules, a rule is rendered for each value of the repeat var.
+type AlertRuleTemplate struct {
+	// Repeat is the name of the var the rule is repeated by, only one rule is rendered if it's empty.
+	Repeat string `json:"repeat"`
+	// Rule is the template alert rule in the format of the alerting provisioning API,
+	// it's read from the JSON file RuleFile or fetched from Grafana by RuleUID if it's nil.
+	Rule     map[string]interface{} `json:"rule"`
+	RuleFile string                 `json:"ruleFile"`
+	RuleUID  string                 `json:"ruleUID"`
+	// PanelID is the template panel the alert rule is for, it defaults to the annotation __panelId__ of the rule.
+	// The rendered rule is linked to the panel rendered for the same value, and the queries of the panel
+	// are added to the data of the rule, so a panel can be the alert source with only the expressions in the rule.
+	PanelID int `json:"panelId"`
+}
+
+// AlertRuleGroup is a group of the rendered alert rules.
+type AlertRuleGroup struct {
+	FolderUID string
+	Folder    string
+	Name      string
+	Interval  time.Duration
+	OrgID     int64
+	Rules     []map[string]interface{}
+}
+
+const defaultAlertRuleInterval = time.Minute
+
+// RenderAlertRules renders the alert rules for the dashboard rendered from the template dashboard,
+// dashboardUID is the UID of the rendered dashboard. The rules can't be fetched by RuleUID.
+func RenderAlertRules(body []byte, vars RenderVars, options RenderOptions, config AlertRulesConfig,
+	dashboardUID string) (AlertRuleGroup, error) {
+	return renderAlertRules(context.Background(), nil, body, vars, options, config, dashboardUID)
+}
+
+// PushAlertRuleGroup creates or updates the alert rules through the alerting provisioning API of Grafana.
+func PushAlertRuleGroup(config UpdateConfig, group AlertRuleGroup) error {
+	cli, err := newAPIClient(config)
+	if err != nil {
+		return err
+	}
+	return pushAlertRuleGroup(context.Background(), cli, group)
+}
+
+func renderAlertRules(ctx context.Context, cli *apiClient, body []byte, vars RenderVars, options RenderOptions,
+	config AlertRulesConfig, dashboardUID string) (AlertRuleGroup, error) {
+	group := AlertRuleGroup{
+		FolderUID: config.FolderUID,
+		Folder:    config.Folder,
+		Name:      config.Group,
+		Interval:  defaultAlertRuleInterval,
+		OrgID:     config.OrgID,
+	}
+	if config.Interval != "" {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil {
+			return group, fmt.Errorf("invalid interval of the alert rule group: %v", err)
+		}
+		group.Interval = interval
+	}
+
+	dashboard, err := simplejson.NewJson(body)
+	if err != nil {
+		return group, err
+	}
+	r := newRenderer(dashboard, vars, options)
+	if _, err = r.render(dashboard); err != nil {
+		return group, err
+	}
+
+	for _, tmpl := range config.Rules {
+		rule, err := loadAlertRule(ctx, cli, tmpl)
+		if err != nil {
+			return group, err
+		}
+		rules, err := r.renderAlertRule(tmpl, rule, dashboardUID)
+		if err != nil {
+			return group, err
+		}
+		for _, rule := range rules {
+			rule["folderUID"] = config.FolderUID
+			rule["ruleGroup"] = config.Group
+		}
+		group.Rules = append(group.Rules, rules...)
+	}
+	return group, nil
+}
+
+// loadAlertRule returns the template alert rule from the config, the file or Grafana.
+func loadAlertRule(ctx context.Context, cli *apiClient, tmpl AlertRuleTemplate) (map[string]interface{}, error) {
+	switch {
+	case tmpl.Rule != nil:
+		return tmpl.Rule, nil
+	case tmpl.RuleFile != "":
+		ruleBytes, err := ioutil.ReadFile(tmpl.RuleFile)
+		if err != nil {
+			return nil, err
+		}
+		rule, err := simplejson.NewJson(ruleBytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid alert rule file %s: %v", tmpl.RuleFile, err)
+		}
+		return rule.Map()
+	case tmpl.RuleUID != "":
+		if cli == nil {
+			return nil, fmt.Errorf("alert rule %s can't be fetched without Grafana", tmpl.RuleUID)
+		}
+		var rule map[string]interface{}
+		err := cli.do(ctx, http.MethodGet, "/api/v1/provisioning/alert-rules/"+url.PathEscape(tmpl.RuleUID), nil, &rule)
+		return rule, err
+	}
+	return nil, errors.New("template alert rule is empty")
+}
+
+// renderAlertRule renders the template alert rule for each value of the repeat var.
+func (r *renderer) renderAlertRule(tmpl AlertRuleTemplate, rule map[string]interface{},
+	dashboardUID string) ([]map[string]interface{}, error) {
+	ruleJSON := simplejson.NewFromAny(rule)
+	title := ruleJSON.Get("title").MustString()
+	uid := ruleJSON.Get("uid").MustString()
+	if uid == "" {
+		uid = hashUID(title)
+	}
+	panelID := tmpl.PanelID
+	if panelID == 0 {
+		panelID, _ = strconv.Atoi(ruleJSON.GetPath("annotations", "__panelId__").MustString())
+	}
+	scopes, err := r.alertRuleScopes(tmpl.Repeat, panelID)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered []map[string]interface{}
+	for _, scope := range scopes {
+		vars := scope.vars
+		res := renderStrings(rule, nil, func(s string, _ string) string {
+			return interpolate(s, vars, "")
+		}).(map[string]interface{})
+
+		// the rules of a group have their own titles and UIDs
+		if len(scope.repeats) > 0 {
+			if missing := unreferenced(title, scope.repeats); len(missing) > 0 {
+				res["title"] = interpolate(title, vars, "") + interpolate(r.alertNameSuffix(missing), vars, "")
+			}
+			res["uid"] = repeatedUID(uid, scope)
+		} else {
+			res["uid"] = uid
+		}
+		for _, k := range []string{"id", "orgID", "updated", "provenance"} {
+			delete(res, k)
+		}
+
+		if panelID != 0 {
+			if err := r.linkAlertRule(res, panelID, scope, dashboardUID); err != nil {
+				return nil, err
+			}
+		}
+		rendered = append(rendered, res)
+	}
+	return rendered, nil
+}
+
+// alertRuleScopes returns the scopes the alert rule is rendered in, one for each value of the repeat var,
+// or one for each copy of the panel if the panel is repeated by the var, e.g. in a repeated row.
+func (r *renderer) alertRuleScopes(repeat string, panelID int) ([]renderScope, error) {
+	global := r.globalScope()
+	if repeat == "" {
+		return []renderScope{global}, nil
+	}
+	if panelID != 0 {
+		var scopes []renderScope
+		for _, c := range r.copies {
+			if c.templateID == panelID && containsString(c.scope.repeats, repeat) {
+				scopes = append(scopes, c.scope)
+			}
+		}
+		if len(scopes) > 0 {
+			return scopes, nil
+		}
+	}
+
+	repeatVar, ok := r.vars.getVar(repeat)
+	if !ok {
+		return nil, fmt.Errorf("var %s of the alert rule isn't found", repeat)
+	}
+	scopes := make([]renderScope, 0, len(repeatVar.Values))
+	for _, v := range repeatVar.Values {
+		scope, err := r.repeatScope(global, repeatVar, v)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, scope)
+	}
+	return scopes, nil
+}
+
+// linkAlertRule links the alert rule to the panel rendered from the template panel with the same repeat values,
+// and adds the queries of the panel to the rule.
+func (r *renderer) linkAlertRule(rule map[string]interface{}, panelID int, scope renderScope, dashboardUID string) error {
+	panel, ok := r.panelCopyOf(panelID, scope)
+	if !ok {
+		return fmt.Errorf("panel %d of the alert rule %v isn't rendered", panelID, rule["title"])
+	}
+
+	var data []interface{}
+	refIDs := make(map[string]bool)
+	for _, query := range simplejson.NewFromAny(rule).Get("data").MustArray() {
+		refID, _ := simplejson.NewFromAny(query).Get("refId").String()
+		refIDs[refID] = true
+	}
+	panelJSON := simplejson.NewFromAny(panel)
+	for i := range panelJSON.Get("targets").MustArray() {
+		target := panelJSON.Get("targets").GetIndex(i)
+		refID := target.Get("refId").MustString()
+		if refIDs[refID] {
+			continue
+		}
+		datasourceUID := target.GetPath("datasource", "uid").MustString()
+		if datasourceUID == "" {
+			datasourceUID = panelJSON.GetPath("datasource", "uid").MustString()
+		}
+		data = append(data, map[string]interface{}{
+			"refId":             refID,
+			"relativeTimeRange": map[string]interface{}{"from": 600, "to": 0},
+			"datasourceUid":     datasourceUID,
+			"model":             target.Interface(),
+		})
+	}
+	rule["data"] = append(data, simplejson.NewFromAny(rule).Get("data").MustArray()...)
+
+	annotations := simplejson.NewFromAny(rule).Get("annotations").MustMap(map[string]interface{}{})
+	annotations["__dashboardUid__"] = dashboardUID
+	annotations["__panelId__"] = strconv.Itoa(panelJSON.Get("id").MustInt())
+	rule["annotations"] = annotations
+	return nil
+}
+
+// panelCopyOf returns the panel rendered from the template panel with the values of the repeat variables in scope.
+func (r *renderer) panelCopyOf(templateID int, scope renderScope) (map[string]interface{}, bool) {
+	for _, c := range r.copies {
+		if c.templateID != templateID {
+			continue
+		}
+		matched := true
+		for _, name := range scope.repeats {
+			if !reflect.DeepEqual(c.scope.vars[name], scope.vars[name]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return c.panel, true
+		}
+	}
+	return nil, false
+}
+
+// repeatedUID returns the UID of the copy rendered with the values of the repeat variables in scope.
+func repeatedUID(uid string, scope renderScope) string {
+	var key []string
+	for _, name := range scope.repeats {
+		key = append(key, name, fmt.Sprint(scope.vars[name].values))
+	}
+	return derivedUID(uid, key...)
+}
+
+// pushAlertRuleGroup creates or updates the alert rules one by one, and then updates the rule group.
+func pushAlertRuleGroup(ctx context.Context, cli *apiClient, group AlertRuleGroup) error {
+	for _, rule := range group.Rules {
+		uid, _ := rule["uid"].(string)
+		err := cli.do(ctx, http.MethodPut, "/api/v1/provisioning/alert-rules/"+url.PathEscape(uid), rule, nil)
+		if isNotFound(err) {
+			err = cli.do(ctx, http.MethodPost, "/api/v1/provisioning/alert-rules", rule, nil)
+		}
+		if err != nil {
+			return fmt.Errorf("fail to push the alert rule %v: %w", rule["title"], err)
+		}
+	}
+
+	path := fmt.Sprintf("/api/v1/provisioning/folder/%s/rule-groups/%s",
+		url.PathEscape(group.FolderUID), url.PathEscape(group.Name))
+	err := cli.do(ctx, http.MethodPut, path, map[string]interface{}{
+		"title":     group.Name,
+		"folderUid": group.FolderUID,
+		"interval":  int(group.Interval.Seconds()),
+		"rules":     group.Rules,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("fail to update the alert rule group %s: %w", group.Name, err)
+	}
+	return nil
+}
+
+// provisioningFile is the alerting file provisioning format of Grafana.
+type provisioningFile struct {
+	APIVersion int                 `yaml:"apiVersion"`
+	Groups     []provisioningGroup `yaml:"groups"`
+}
+
+type provisioningGroup struct {
+	OrgID    int64         `yaml:"orgId"`
+	Name     string        `yaml:"name"`
+	Folder   string        `yaml:"folder"`
+	Interval string        `yaml:"interval"`
+	Rules    []interface{} `yaml:"rules"`
+}
+
+// ProvisioningYAML returns the rule group in the alerting file provisioning format of Grafana.
+func (g AlertRuleGroup) ProvisioningYAML() ([]byte, error) {
+	if g.Folder == "" {
+		return nil, errors.New("folder title of the alert rule group is required by file provisioning")
+	}
+
+	orgID := g.OrgID
+	if orgID == 0 {
+		orgID = 1
+	}
+	group := provisioningGroup{
+		OrgID:    orgID,
+		Name:     g.Name,
+		Folder:   g.Folder,
+		Interval: fmt.Sprintf("%ds", int(g.Interval.Seconds())),
+	}
+	for _, rule := range g.Rules {
+		fileRule := make(map[string]interface{}, len(rule))
+		for k, v := range rule {
+			if k != "folderUID" && k != "ruleGroup" {
+				fileRule[k] = v
+			}
+		}
+
+		// convert the JSON numbers to plain numbers for YAML
+		var plain interface{}
+		ruleBytes, err := json.Marshal(fileRule)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(ruleBytes, &plain); err != nil {
+			return nil, err
+		}
+		group.Rules = append(group.Rules, plain)
+	}
+
+	return yaml.Marshal(provisioningFile{APIVersion: 1, Groups: []provisioningGroup{group}})
+}
+
+// writeAlertRuleGroup writes the rule group to the file provisioning YAML file.
+func writeAlertRuleGroup(group AlertRuleGroup, file string) error {
+	yamlBytes, err := group.ProvisioningYAML()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, yamlBytes, 0644)
+}
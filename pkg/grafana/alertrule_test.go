@@ -0,0 +1,257 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+const alertSourceDashboard = `{"panels": [
+  {"type": "row", "id": 1, "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "timeseries", "id": 2, "title": "$SERVICE_NAME latency", "gridPos": {"h": 8, "w": 24, "x": 0, "y": 1},
+   "datasource": {"type": "prometheus", "uid": "prom"},
+   "targets": [{"expr": "latency{service=\"$SERVICE_NAME\"}", "refId": "A"}]}
+]}`
+
+const templateAlertRule = `{
+  "uid": "latency",
+  "title": "High latency",
+  "condition": "B",
+  "for": "5m",
+  "noDataState": "NoData",
+  "execErrState": "Alerting",
+  "annotations": {"summary": "$SERVICE_NAME is slow", "__panelId__": "2"},
+  "labels": {"service": "$SERVICE_NAME"},
+  "data": [{"refId": "B", "datasourceUid": "__expr__", "model": {"type": "threshold", "expression": "A"}}]
+}`
+
+var alertRuleVars = RenderVars{
+	{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}},
+}
+
+func alertRulesConfig(t *testing.T) AlertRulesConfig {
+	var rule map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(templateAlertRule), &rule))
+	return AlertRulesConfig{
+		FolderUID: "alerts",
+		Folder:    "Alerts",
+		Group:     "services",
+		Interval:  "2m",
+		Rules:     []AlertRuleTemplate{{Repeat: "SERVICE_NAME", Rule: rule}},
+	}
+}
+
+func TestRenderAlertRules(t *testing.T) {
+	group, err := RenderAlertRules([]byte(alertSourceDashboard), alertRuleVars, RenderOptions{},
+		alertRulesConfig(t), "rendered")
+	assert.Nil(t, err)
+	assert.Len(t, group.Rules, 2)
+
+	// the rules are linked to the panels with the same IDs in the rendered dashboard
+	dashboard, err := RenderDashboard([]byte(alertSourceDashboard), alertRuleVars)
+	assert.Nil(t, err)
+	var rendered struct {
+		Panels []renderedPanel `json:"panels"`
+	}
+	assert.Nil(t, json.Unmarshal(dashboard, &rendered))
+	panelIDs := make(map[string]string)
+	for _, p := range rendered.Panels {
+		panelIDs[p.Title] = strconv.Itoa(p.ID)
+	}
+
+	uids := make(map[string]bool)
+	for i, service := range []string{"news", "payment"} {
+		rule := group.Rules[i]
+		assert.Equal(t, "High latency ("+service+")", rule["title"])
+		assert.Equal(t, "alerts", rule["folderUID"])
+		assert.Equal(t, "services", rule["ruleGroup"])
+		assert.True(t, strings.HasPrefix(rule["uid"].(string), "latency-"))
+		assert.LessOrEqual(t, len(rule["uid"].(string)), maxUIDLength)
+		uids[rule["uid"].(string)] = true
+
+		assert.Equal(t, map[string]interface{}{
+			"summary":          service + " is slow",
+			"__dashboardUid__": "rendered",
+			"__panelId__":      panelIDs[service+" latency"],
+		}, rule["annotations"])
+		assert.Equal(t, map[string]interface{}{"service": service}, rule["labels"])
+
+		// the queries of the panel are prepended to the expressions
+		data := rule["data"].([]interface{})
+		assert.Len(t, data, 2)
+		query := data[0].(map[string]interface{})
+		assert.Equal(t, "A", query["refId"])
+		assert.Equal(t, "prom", query["datasourceUid"])
+		assert.Equal(t, `latency{service="`+service+`"}`, query["model"].(map[string]interface{})["expr"])
+		assert.Equal(t, "B", data[1].(map[string]interface{})["refId"])
+	}
+	assert.Len(t, uids, 2)
+
+	// the UIDs are stable
+	again, err := RenderAlertRules([]byte(alertSourceDashboard), alertRuleVars, RenderOptions{},
+		alertRulesConfig(t), "rendered")
+	assert.Nil(t, err)
+	assert.Equal(t, group.Rules[0]["uid"], again.Rules[0]["uid"])
+}
+
+func TestRenderAlertRulesNestedRepeat(t *testing.T) {
+	var rule map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(`{"uid": "latency", "title": "High latency in $REGION",
+  "annotations": {"__panelId__": "2"}, "labels": {"service": "$SERVICE_NAME", "region": "$REGION"}}`), &rule))
+	config := AlertRulesConfig{Group: "services", Rules: []AlertRuleTemplate{{Repeat: "SERVICE_NAME", Rule: rule}}}
+
+	dashboard := sprintfJSON(nestedAlertDashboard, "$SERVICE_NAME latency in $REGION")
+	group, err := RenderAlertRules([]byte(dashboard), nestedAlertVars, RenderOptions{}, config, "rendered")
+	assert.Nil(t, err)
+
+	// a rule for each copy of the panel, in every region
+	var titles []string
+	uids := make(map[string]bool)
+	for _, r := range group.Rules {
+		titles = append(titles, r["title"].(string))
+		uids[r["uid"].(string)] = true
+		labels := r["labels"].(map[string]interface{})
+		assert.Contains(t, r["title"], labels["region"])
+		assert.Contains(t, r["title"], labels["service"])
+	}
+	assert.Equal(t, []string{
+		"High latency in eu (news)", "High latency in eu (payment)",
+		"High latency in us (news)", "High latency in us (payment)",
+	}, titles)
+	assert.Len(t, uids, 4)
+}
+
+func TestAlertRuleGroupProvisioningYAML(t *testing.T) {
+	group, err := RenderAlertRules([]byte(alertSourceDashboard), alertRuleVars, RenderOptions{},
+		alertRulesConfig(t), "rendered")
+	assert.Nil(t, err)
+
+	yamlBytes, err := group.ProvisioningYAML()
+	assert.Nil(t, err)
+
+	var file struct {
+		APIVersion int `yaml:"apiVersion"`
+		Groups     []struct {
+			OrgID    int                      `yaml:"orgId"`
+			Name     string                   `yaml:"name"`
+			Folder   string                   `yaml:"folder"`
+			Interval string                   `yaml:"interval"`
+			Rules    []map[string]interface{} `yaml:"rules"`
+		} `yaml:"groups"`
+	}
+	assert.Nil(t, yaml.Unmarshal(yamlBytes, &file))
+	assert.Equal(t, 1, file.APIVersion)
+	assert.Len(t, file.Groups, 1)
+	assert.Equal(t, 1, file.Groups[0].OrgID)
+	assert.Equal(t, "services", file.Groups[0].Name)
+	assert.Equal(t, "Alerts", file.Groups[0].Folder)
+	assert.Equal(t, "120s", file.Groups[0].Interval)
+	assert.Len(t, file.Groups[0].Rules, 2)
+	assert.Equal(t, "High latency (news)", file.Groups[0].Rules[0]["title"])
+	assert.NotContains(t, file.Groups[0].Rules[0], "folderUID")
+	assert.Contains(t, string(yamlBytes), "from: 600")
+
+	group.Folder = ""
+	_, err = group.ProvisioningYAML()
+	assert.NotNil(t, err)
+}
+
+// fakeAlertingAPI is a stand-in of the Grafana alerting provisioning API.
+type fakeAlertingAPI struct {
+	sync.Mutex
+	rules    map[string]map[string]interface{}
+	groups   map[string]map[string]interface{}
+	requests []string
+}
+
+func (f *fakeAlertingAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	f.requests = append(f.requests, req.Method+" "+req.URL.Path)
+
+	if req.Header.Get("Authorization") != "Bearer api-key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body map[string]interface{}
+	bodyBytes, _ := ioutil.ReadAll(req.Body)
+	_ = json.Unmarshal(bodyBytes, &body)
+
+	const rulesPath = "/api/v1/provisioning/alert-rules"
+	switch {
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, rulesPath+"/"):
+		rule, ok := f.rules[strings.TrimPrefix(req.URL.Path, rulesPath+"/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(rule)
+	case req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, rulesPath+"/"):
+		uid := strings.TrimPrefix(req.URL.Path, rulesPath+"/")
+		if _, ok := f.rules[uid]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		f.rules[uid] = body
+	case req.Method == http.MethodPost && req.URL.Path == rulesPath:
+		f.rules[body["uid"].(string)] = body
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodPut && strings.HasPrefix(req.URL.Path, "/api/v1/provisioning/folder/"):
+		f.groups[req.URL.Path] = body
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestPushAlertRuleGroup(t *testing.T) {
+	var rule map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(templateAlertRule), &rule))
+	api := &fakeAlertingAPI{
+		rules:  map[string]map[string]interface{}{"latency": rule},
+		groups: map[string]map[string]interface{}{},
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	config := UpdateConfig{APIUrl: server.URL, BasicAuth: "api-key"}
+	rulesConfig := alertRulesConfig(t)
+	rulesConfig.Rules[0].Rule = nil
+	rulesConfig.Rules[0].RuleUID = "latency"
+
+	cli, err := newAPIClient(config)
+	assert.Nil(t, err)
+	group, err := renderAlertRules(context.Background(), cli, []byte(alertSourceDashboard), alertRuleVars, RenderOptions{},
+		rulesConfig, "rendered")
+	assert.Nil(t, err)
+	assert.Len(t, group.Rules, 2)
+
+	// create the rules at first, and update them later
+	assert.Nil(t, PushAlertRuleGroup(config, group))
+	assert.Nil(t, PushAlertRuleGroup(config, group))
+	assert.Len(t, api.rules, 3)
+	for _, r := range group.Rules {
+		assert.Equal(t, r["title"], api.rules[r["uid"].(string)]["title"])
+	}
+	assert.Equal(t, float64(120), api.groups["/api/v1/provisioning/folder/alerts/rule-groups/services"]["interval"])
+
+	uid := group.Rules[0]["uid"].(string)
+	assert.Equal(t, []string{
+		"GET /api/v1/provisioning/alert-rules/latency",
+		"PUT /api/v1/provisioning/alert-rules/" + uid,
+		"POST /api/v1/provisioning/alert-rules",
+	}, api.requests[:3])
+
+	err = PushAlertRuleGroup(UpdateConfig{APIUrl: server.URL, BasicAuth: "wrong"}, group)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "HTTP error 401")
+}
@@ -0,0 +1,81 @@
+package grafana
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Auth is the credentials of the Grafana API.
+type Auth struct {
+	// Token is an API key or a service account token, it's sent as the bearer token.
+	Token string `json:"token"`
+	// Username and Password are the basic auth credentials of a Grafana user.
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// authHeader returns the Authorization header of the credentials in the config, the legacy BasicAuth is
+// either the basic auth `user:password` or an API key like the sdk takes it.
+func (c UpdateConfig) authHeader() string {
+	switch {
+	case c.Auth.Token != "":
+		return "Bearer " + c.Auth.Token
+	case c.Auth.Username != "":
+		return basicAuthHeader(c.Auth.Username, c.Auth.Password)
+	case strings.Contains(c.BasicAuth, ":"):
+		parts := strings.SplitN(c.BasicAuth, ":", 2)
+		return basicAuthHeader(parts[0], parts[1])
+	case c.BasicAuth != "":
+		return "Bearer " + c.BasicAuth
+	}
+	return ""
+}
+
+func basicAuthHeader(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// AuthError is the error of Grafana rejecting the credentials (401) or the permissions of them (403).
+type AuthError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *AuthError) Error() string {
+	reason := "the credentials are missing or invalid, check the token or the username and password"
+	if e.StatusCode == http.StatusForbidden {
+		reason = "the credentials have no permission, check the role of the user or the service account"
+	}
+	return fmt.Sprintf("%s %s: HTTP error %d: %s: %s", e.Method, e.Path, e.StatusCode, reason, e.Body)
+}
+
+// authTransport sets the Authorization header of the requests, and turns the 401 and 403 responses into AuthError.
+type authTransport struct {
+	header string
+	base   http.RoundTripper
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	// the sdk always sets its own header, even if there are no credentials
+	if t.header != "" {
+		req.Header.Set("Authorization", t.header)
+	} else {
+		req.Header.Del("Authorization")
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, &AuthError{Method: req.Method, Path: req.URL.Path, StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return resp, nil
+}
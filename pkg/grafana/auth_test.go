@@ -0,0 +1,70 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   UpdateConfig
+		expected string
+	}{
+		{"none", UpdateConfig{}, ""},
+		{"token", UpdateConfig{Auth: Auth{Token: "glsa_token"}}, "Bearer glsa_token"},
+		{"username and password", UpdateConfig{Auth: Auth{Username: "admin", Password: "p:ss"}}, "Basic YWRtaW46cDpzcw=="},
+		{"basic auth", UpdateConfig{BasicAuth: "admin:p:ss"}, "Basic YWRtaW46cDpzcw=="},
+		{"api key in basic auth", UpdateConfig{BasicAuth: "api-key"}, "Bearer api-key"},
+		{"token over basic auth", UpdateConfig{BasicAuth: "admin:admin", Auth: Auth{Token: "glsa_token"}}, "Bearer glsa_token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.config.authHeader())
+		})
+	}
+}
+
+func TestAuthErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.Header.Get("Authorization") {
+		case "Bearer viewer":
+			w.WriteHeader(http.StatusForbidden)
+		case "Bearer editor":
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		token      string
+		statusCode int
+	}{
+		{"", http.StatusUnauthorized},
+		{"wrong", http.StatusUnauthorized},
+		{"viewer", http.StatusForbidden},
+		{"editor", 0},
+	}
+	for _, test := range tests {
+		config := UpdateConfig{APIUrl: server.URL, Auth: Auth{Token: test.token}}
+		cli, err := newAPIClient(config)
+		assert.Nil(t, err)
+		err = cli.do(context.Background(), http.MethodGet, "/api/folders/x", nil, nil)
+		if test.statusCode == 0 {
+			assert.Nil(t, err)
+			continue
+		}
+
+		var authErr *AuthError
+		assert.True(t, errors.As(err, &authErr), "token %q", test.token)
+		assert.Equal(t, test.statusCode, authErr.StatusCode)
+		assert.Contains(t, err.Error(), "credentials")
+	}
+}
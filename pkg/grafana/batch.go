@@ -0,0 +1,128 @@
+package grafana
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// defaultConcurrency is the number of the jobs running at a time by default.
+const defaultConcurrency = 4
+
+// Manifest is a batch of the render jobs.
+type Manifest struct {
+	// Concurrency is the max number of the jobs running at a time, it defaults to 4.
+	Concurrency int   `json:"concurrency"`
+	Jobs        []Job `json:"jobs"`
+}
+
+// Job renders a template dashboard, from the JSON file Template or from Grafana by TemplateUID,
+// into the target dashboard with its own variables.
+type Job struct {
+	// Name identifies the job, the UID of the rendered dashboard is derived from it unless UID is given.
+	Name        string `json:"name"`
+	Template    string `json:"template"`
+	TemplateUID string `json:"templateUID"`
+	// Title, UID and Folder are the title, the UID and the folder UID of the rendered dashboard,
+	// FolderTitle selects the folder by the path of the titles instead.
+	Title       string           `json:"title"`
+	UID         string           `json:"uid"`
+	Folder      string           `json:"folder"`
+	FolderTitle string           `json:"folderTitle"`
+	Vars        RenderVars       `json:"vars"`
+	Render      RenderOptions    `json:"render"`
+	AlertRules  AlertRulesConfig `json:"alertRules"`
+	FanOut      FanOutConfig     `json:"fanOut"`
+}
+
+// JobResult is the result of a job, Err is nil if the job succeeded.
+type JobResult struct {
+	Job Job
+	Err error
+}
+
+// JobFunc renders the dashboards of the job with the config and the template source of the job.
+type JobFunc func(config UpdateConfig, source TemplateSource, vars RenderVars) error
+
+// Validate checks that the jobs have distinct names and exactly one template.
+func (m Manifest) Validate() error {
+	if len(m.Jobs) == 0 {
+		return errors.New("the manifest has no job")
+	}
+	names := make(map[string]bool, len(m.Jobs))
+	for i, job := range m.Jobs {
+		if job.Name == "" {
+			return fmt.Errorf("the job #%d has no name", i+1)
+		}
+		if names[job.Name] {
+			return fmt.Errorf("the job name %q is used by more than one job", job.Name)
+		}
+		names[job.Name] = true
+		if (job.Template == "") == (job.TemplateUID == "") {
+			return fmt.Errorf("the job %q needs either template or templateUID", job.Name)
+		}
+	}
+	return nil
+}
+
+// UpdateConfig returns the config of the job based on the config shared by all the jobs, e.g. the Grafana API.
+func (j Job) UpdateConfig(base UpdateConfig) UpdateConfig {
+	config := base
+	config.DashboardUID = j.TemplateUID
+	config.Name = j.Name
+	config.RenderedUID = j.UID
+	config.Title = j.Title
+	config.FolderUID = j.Folder
+	config.FolderTitle = j.FolderTitle
+	config.RenderOptions = j.Render
+	config.AlertRules = j.AlertRules
+	config.FanOut = j.FanOut
+	return config
+}
+
+// Source returns the template source of the job.
+func (j Job) Source(config UpdateConfig) (TemplateSource, error) {
+	if j.Template != "" {
+		return NewFileTemplateSource(j.Template), nil
+	}
+	grafcli, err := NewTemplateClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewAPITemplateSource(grafcli, j.TemplateUID), nil
+}
+
+// RunManifest runs the jobs of the manifest by fn with at most Concurrency jobs at a time,
+// and returns the results in the order of the jobs.
+func RunManifest(base UpdateConfig, manifest Manifest, fn JobFunc) []JobResult {
+	concurrency := manifest.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+
+	results := make([]JobResult, len(manifest.Jobs))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, job := range manifest.Jobs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, job Job) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = JobResult{Job: job, Err: runJob(base, job, fn)}
+		}(i, job)
+	}
+	wg.Wait()
+	return results
+}
+
+func runJob(base UpdateConfig, job Job, fn JobFunc) error {
+	config := job.UpdateConfig(base)
+	source, err := job.Source(config)
+	if err != nil {
+		return err
+	}
+	return fn(config, source, job.Vars)
+}
@@ -0,0 +1,78 @@
+package grafana
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest Manifest
+		valid    bool
+	}{
+		{"valid", Manifest{Jobs: []Job{{Name: "a", Template: "a.json"}, {Name: "b", TemplateUID: "b"}}}, true},
+		{"no job", Manifest{}, false},
+		{"no name", Manifest{Jobs: []Job{{Template: "a.json"}}}, false},
+		{"same name", Manifest{Jobs: []Job{{Name: "a", Template: "a.json"}, {Name: "a", TemplateUID: "b"}}}, false},
+		{"no template", Manifest{Jobs: []Job{{Name: "a"}}}, false},
+		{"both templates", Manifest{Jobs: []Job{{Name: "a", Template: "a.json", TemplateUID: "a"}}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.valid, test.manifest.Validate() == nil)
+		})
+	}
+}
+
+func TestRunManifest(t *testing.T) {
+	var jobs []Job
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		jobs = append(jobs, Job{Name: name, Template: name + ".json", Title: "title " + name, Folder: "team"})
+	}
+
+	var (
+		mu             sync.Mutex
+		running, peak  int
+		renderedTitles = make(map[string]string)
+	)
+	results := RunManifest(UpdateConfig{APIUrl: "http://grafana"}, Manifest{Concurrency: 2, Jobs: jobs},
+		func(config UpdateConfig, source TemplateSource, vars RenderVars) error {
+			mu.Lock()
+			running++
+			if running > peak {
+				peak = running
+			}
+			renderedTitles[config.Name] = config.Title
+			mu.Unlock()
+
+			time.Sleep(10 * time.Millisecond)
+			assert.Equal(t, "http://grafana", config.APIUrl)
+			assert.Equal(t, "team", config.FolderUID)
+			assert.IsType(t, &fileTemplateSource{}, source)
+
+			mu.Lock()
+			running--
+			mu.Unlock()
+			if config.Name == "c" {
+				return errors.New("broken")
+			}
+			return nil
+		})
+
+	assert.LessOrEqual(t, peak, 2)
+	assert.Len(t, results, len(jobs))
+	for i, result := range results {
+		assert.Equal(t, jobs[i], result.Job)
+		assert.Equal(t, "title "+result.Job.Name, renderedTitles[result.Job.Name])
+		if result.Job.Name == "c" {
+			assert.EqualError(t, result.Err, "broken")
+		} else {
+			assert.Nil(t, result.Err)
+		}
+	}
+}
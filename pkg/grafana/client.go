@@ -0,0 +1,107 @@
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/grafana-tools/sdk"
+)
+
+// apiClient calls the Grafana HTTP APIs which aren't supported by the sdk.
+type apiClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// newAPIClient returns the client of the Grafana API with the HTTP config and the credentials in the config.
+func newAPIClient(config UpdateConfig) (*apiClient, error) {
+	_, cli, err := newClients(config)
+	return cli, err
+}
+
+// NewClient returns the sdk client of the Grafana API with the HTTP config and the credentials in the config.
+func NewClient(config UpdateConfig) (*sdk.Client, error) {
+	grafcli, _, err := newClients(config)
+	return grafcli, err
+}
+
+// newClients returns the sdk client and the API client of Grafana sharing the same HTTP client,
+// which sends the requests to the org in the config.
+func newClients(config UpdateConfig) (*sdk.Client, *apiClient, error) {
+	httpClient, err := newHTTPClient(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	cli := &apiClient{baseURL: strings.TrimSuffix(config.APIUrl, "/"), client: httpClient}
+	if err := withOrg(context.Background(), cli, config.Org); err != nil {
+		return nil, nil, err
+	}
+	grafcli, err := sdk.NewClient(config.APIUrl, "", httpClient)
+	if err != nil {
+		return nil, nil, err
+	}
+	return grafcli, cli, nil
+}
+
+// APIError is the error response of the Grafana API.
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Body       string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("%s %s: HTTP error %d: %s", e.Method, e.Path, e.StatusCode, e.Body)
+}
+
+// isNotFound tells if the error is the not found response of the Grafana API.
+func isNotFound(err error) bool {
+	apiErr, ok := err.(*APIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+// do sends the request with the body encoded in JSON, and decodes the JSON response into out if it's not nil.
+func (c *apiClient) do(ctx context.Context, method string, path string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return &APIError{Method: method, Path: path, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
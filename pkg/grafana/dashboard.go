@@ -0,0 +1,180 @@
+package grafana
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+// renderedKey is the key of the dashboard JSON where grafops records how the dashboard was rendered.
+const renderedKey = "grafops"
+
+// ErrEditedByHand is returned when the rendered dashboard was changed after grafops saved it,
+// and the config asks not to overwrite it.
+var ErrEditedByHand = errors.New("the rendered dashboard was edited by hand")
+
+// RenderedDashboardUID returns the UID of the rendered dashboard, it's the RenderedUID if it's given,
+// otherwise it's derived from the template UID and the Name, so that re-rendering updates the same dashboard.
+func (c UpdateConfig) RenderedDashboardUID() string {
+	if c.RenderedUID != "" {
+		return c.RenderedUID
+	}
+	return derivedUID(c.DashboardUID, c.Name)
+}
+
+// savedDashboard is the dashboard saved in Grafana.
+type savedDashboard struct {
+	Dashboard map[string]interface{} `json:"dashboard"`
+	Meta      struct {
+		Version  int `json:"version"`
+		FolderID int `json:"folderId"`
+	} `json:"meta"`
+}
+
+// getDashboard fetches the dashboard by UID, it returns nil if the dashboard doesn't exist.
+func getDashboard(ctx context.Context, cli *apiClient, uid string) (*savedDashboard, error) {
+	var saved savedDashboard
+	err := cli.do(ctx, http.MethodGet, "/api/dashboards/uid/"+url.PathEscape(uid), nil, &saved)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+// dashboardByTitle returns the dashboard with the title in the folder, or nil if there is none.
+func dashboardByTitle(ctx context.Context, cli *apiClient, title string, folderID int) (*savedDashboard, error) {
+	query := url.Values{"query": {title}, "type": {"dash-db"}, "folderIds": {strconv.Itoa(folderID)}}
+	var hits []struct {
+		UID   string `json:"uid"`
+		Title string `json:"title"`
+	}
+	if err := cli.do(ctx, http.MethodGet, "/api/search?"+query.Encode(), nil, &hits); err != nil {
+		return nil, err
+	}
+	for _, h := range hits {
+		if h.Title == title {
+			return getDashboard(ctx, cli, h.UID)
+		}
+	}
+	return nil, nil
+}
+
+// adoptDashboard makes the rendered dashboard JSON replace the saved dashboard, which has another UID,
+// Grafana updates the dashboard by its ID and changes the UID.
+func adoptDashboard(jsonBytes []byte, saved *savedDashboard) ([]byte, error) {
+	var dashboard map[string]interface{}
+	if err := json.Unmarshal(jsonBytes, &dashboard); err != nil {
+		return nil, err
+	}
+	dashboard["id"] = saved.Dashboard["id"]
+	dashboard["version"] = saved.Meta.Version
+	return json.Marshal(dashboard)
+}
+
+// renderedFrom tells if the dashboard was rendered from the template dashboard JSON before grafops recorded
+// the marker: it has no marker, and it has the template variables and the panel types of the template.
+func (d *savedDashboard) renderedFrom(template []byte) bool {
+	if _, ok := d.Dashboard[renderedKey]; ok {
+		return false
+	}
+	var tmpl map[string]interface{}
+	if err := json.Unmarshal(template, &tmpl); err != nil {
+		return false
+	}
+	return reflect.DeepEqual(shapeOf(d.Dashboard), shapeOf(tmpl))
+}
+
+// dashboardShape is what the rendering keeps of the template dashboard.
+type dashboardShape struct {
+	vars       []string
+	panelTypes []string
+}
+
+// shapeOf returns the names of the template variables and the sorted types of the panels of the dashboard.
+func shapeOf(dashboard map[string]interface{}) dashboardShape {
+	var shape dashboardShape
+	body := simplejson.NewFromAny(dashboard)
+	vars, _ := body.GetPath("templating", "list").Array()
+	for _, v := range vars {
+		name, _ := simplejson.NewFromAny(v).Get("name").String()
+		shape.vars = append(shape.vars, name)
+	}
+	types := make(map[string]bool)
+	panels, _ := body.Get("panels").Array()
+	for _, p := range panels {
+		panelType, _ := simplejson.NewFromAny(p).Get("type").String()
+		if !types[panelType] {
+			types[panelType] = true
+			shape.panelTypes = append(shape.panelTypes, panelType)
+		}
+	}
+	sort.Strings(shape.panelTypes)
+	return shape
+}
+
+// editedByHand tells if the dashboard was changed after grafops saved it, or it wasn't saved by grafops at all.
+func (d *savedDashboard) editedByHand() bool {
+	marker, _ := d.Dashboard[renderedKey].(map[string]interface{})
+	checksum, _ := marker["checksum"].(string)
+	return checksum == "" || checksum != dashboardChecksum(d.Dashboard)
+}
+
+// prepareRendered sets the UID and the version of the rendered dashboard JSON, and records its checksum.
+// Grafana rejects the dashboard if the version is older than the saved one, so version is the version
+// of the saved dashboard the rendered one replaces, or 0 if there is none.
+func prepareRendered(jsonBytes []byte, uid string, version int) ([]byte, error) {
+	var dashboard map[string]interface{}
+	if err := json.Unmarshal(jsonBytes, &dashboard); err != nil {
+		return nil, err
+	}
+	delete(dashboard, "id")
+	delete(dashboard, "version")
+	dashboard["uid"] = uid
+	dashboard[renderedKey] = map[string]interface{}{
+		"checksum": dashboardChecksum(dashboard),
+	}
+	if version > 0 {
+		dashboard["version"] = version
+	}
+	return json.Marshal(dashboard)
+}
+
+// dashboardChecksum returns the checksum of the dashboard JSON, except the fields Grafana updates on saving.
+func dashboardChecksum(dashboard map[string]interface{}) string {
+	content := make(map[string]interface{}, len(dashboard))
+	for k, v := range dashboard {
+		switch k {
+		case "id", "uid", "version", renderedKey:
+		default:
+			content[k] = v
+		}
+	}
+	// the keys of the maps are sorted, so the same content always has the same JSON
+	contentBytes, _ := json.Marshal(content)
+	sum := sha1.Sum(contentBytes)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkRenderedUID makes sure the rendered dashboard won't overwrite the template.
+func checkRenderedUID(config UpdateConfig, uid string) error {
+	if uid == config.DashboardUID {
+		return fmt.Errorf("the rendered dashboard UID %q is the template dashboard UID", uid)
+	}
+	if len(uid) > maxUIDLength {
+		return fmt.Errorf("the rendered dashboard UID %q is longer than %d characters", uid, maxUIDLength)
+	}
+	return nil
+}
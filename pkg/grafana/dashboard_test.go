@@ -0,0 +1,146 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderedDashboardUID(t *testing.T) {
+	prod := UpdateConfig{DashboardUID: "RKAQZi9Zk", Name: "prod"}
+	staging := UpdateConfig{DashboardUID: "RKAQZi9Zk", Name: "staging"}
+
+	assert.Equal(t, prod.RenderedDashboardUID(), prod.RenderedDashboardUID())
+	assert.NotEqual(t, prod.RenderedDashboardUID(), staging.RenderedDashboardUID())
+	assert.Regexp(t, "^RKAQZi9Zk-[0-9a-f]{12}$", prod.RenderedDashboardUID())
+	assert.Nil(t, checkRenderedUID(prod, prod.RenderedDashboardUID()))
+
+	prod.RenderedUID = "svc-prod"
+	assert.Equal(t, "svc-prod", prod.RenderedDashboardUID())
+
+	prod.RenderedUID = prod.DashboardUID
+	assert.NotNil(t, checkRenderedUID(prod, prod.RenderedDashboardUID()))
+}
+
+func TestPrepareRendered(t *testing.T) {
+	rendered, err := prepareRendered([]byte(`{"id": 3, "uid": "template", "version": 7, "title": "svc"}`),
+		"rendered", 0)
+	assert.Nil(t, err)
+
+	var saved savedDashboard
+	assert.Nil(t, json.Unmarshal(rendered, &saved.Dashboard))
+	assert.Equal(t, "rendered", saved.Dashboard["uid"])
+	assert.NotContains(t, saved.Dashboard, "id")
+	assert.NotContains(t, saved.Dashboard, "version")
+	assert.False(t, saved.editedByHand())
+
+	// Grafana sets the id and the version on saving
+	saved.Dashboard["id"] = float64(12)
+	saved.Dashboard["version"] = float64(2)
+	assert.False(t, saved.editedByHand())
+
+	saved.Dashboard["title"] = "svc edited"
+	assert.True(t, saved.editedByHand())
+
+	delete(saved.Dashboard, renderedKey)
+	saved.Dashboard["title"] = "svc"
+	assert.True(t, saved.editedByHand())
+
+	rendered, err = prepareRendered(rendered, "rendered", 2)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(rendered, &saved.Dashboard))
+	assert.Equal(t, float64(2), saved.Dashboard["version"])
+}
+
+func TestGetDashboard(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/api/dashboards/uid/rendered" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"dashboard": {"uid": "rendered", "title": "svc"}, "meta": {"version": 5, "folderId": 2}}`))
+	}))
+	defer server.Close()
+	cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL})
+	assert.Nil(t, err)
+
+	saved, err := getDashboard(context.Background(), cli, "rendered")
+	assert.Nil(t, err)
+	assert.Equal(t, 5, saved.Meta.Version)
+	assert.Equal(t, "svc", saved.Dashboard["title"])
+
+	saved, err = getDashboard(context.Background(), cli, "missing")
+	assert.Nil(t, err)
+	assert.Nil(t, saved)
+}
+
+func TestAdoptRendered(t *testing.T) {
+	dashboards := map[string]string{
+		"2": `{"id": 7, "uid": "random", "title": "svc (prod)", "templating": {"list": [{"name": "service"}]},
+			"panels": [{"type": "graph"}, {"type": "row"}, {"type": "graph"}]}`,
+		"3": `{"id": 8, "uid": "handmade", "title": "svc (prod)", "panels": [{"type": "text"}]}`,
+		"4": `{"id": 9, "uid": "rendered", "title": "svc (prod)", "templating": {"list": [{"name": "service"}]},
+			"panels": [{"type": "row"}, {"type": "graph"}], "grafops": {"checksum": "sum"}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		folder := req.URL.Query().Get("folderIds")
+		switch {
+		case req.URL.Path == "/api/search" && dashboards[folder] != "":
+			var dashboard struct {
+				UID string `json:"uid"`
+			}
+			_ = json.Unmarshal([]byte(dashboards[folder]), &dashboard)
+			_, _ = fmt.Fprintf(w, `[{"uid": "other", "title": "svc (prod) 2"}, {"uid": %q, "title": "svc (prod)"}]`,
+				dashboard.UID)
+		case req.URL.Path == "/api/search":
+			_, _ = w.Write([]byte(`[]`))
+		default:
+			for _, dashboard := range dashboards {
+				if strings.Contains(dashboard, fmt.Sprintf(`"uid": %q`, path.Base(req.URL.Path))) {
+					_, _ = fmt.Fprintf(w, `{"dashboard": %s, "meta": {"version": 3}}`, dashboard)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL})
+	assert.Nil(t, err)
+	config := UpdateConfig{DashboardUID: "template", Name: "prod"}
+	template := []byte(`{"uid": "template", "title": "svc", "templating": {"list": [{"name": "service"}]},
+		"panels": [{"type": "row"}, {"type": "graph", "repeat": "service"}]}`)
+	rendered := []byte(`{"uid": "derived", "title": "svc (prod)", "version": 0}`)
+
+	adopted, err := adoptRendered(context.Background(), cli, config, template, rendered, 2)
+	assert.Nil(t, err)
+	var dashboard map[string]interface{}
+	assert.Nil(t, json.Unmarshal(adopted, &dashboard))
+	assert.Equal(t, float64(7), dashboard["id"])
+	assert.Equal(t, float64(3), dashboard["version"])
+	assert.Equal(t, "derived", dashboard["uid"])
+
+	// the dashboard isn't rendered from the template, or it's rendered by grafops with another UID
+	for _, folderID := range []int{0, 3, 4} {
+		adopted, err = adoptRendered(context.Background(), cli, config, template, rendered, folderID)
+		assert.Nil(t, err)
+		assert.Equal(t, rendered, adopted)
+	}
+
+	// the template itself is never taken over
+	adopted, err = adoptRendered(context.Background(), cli, UpdateConfig{DashboardUID: "random"}, template, rendered, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, rendered, adopted)
+
+	config.FailOnManualEdit = true
+	_, err = adoptRendered(context.Background(), cli, config, template, rendered, 2)
+	assert.True(t, errors.Is(err, ErrEditedByHand))
+}
@@ -0,0 +1,351 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ChangeKind is the kind of a change between the deployed and the rendered dashboard.
+type ChangeKind string
+
+const (
+	Added   ChangeKind = "added"
+	Removed ChangeKind = "removed"
+	Changed ChangeKind = "changed"
+)
+
+// Change is a difference between the deployed and the rendered JSON value at the path, e.g. `targets[A].expr`.
+type Change struct {
+	Path string
+	Kind ChangeKind
+	Old  interface{}
+	New  interface{}
+}
+
+// PanelDiff is the changes of a panel, the panels are matched by their titles.
+type PanelDiff struct {
+	Title string
+	// Kind is Added or Removed if the whole panel is, otherwise it's Changed.
+	Kind    ChangeKind
+	Changes []Change
+}
+
+// DashboardDiff is the structural diff between the deployed and the rendered dashboard.
+type DashboardDiff struct {
+	// Changes are the changes outside the panels.
+	Changes []Change
+	Panels  []PanelDiff
+}
+
+// Empty tells if there is no drift between the deployed and the rendered dashboard.
+func (d DashboardDiff) Empty() bool {
+	return len(d.Changes) == 0 && len(d.Panels) == 0
+}
+
+func (d DashboardDiff) String() string {
+	var b strings.Builder
+	if len(d.Changes) > 0 {
+		b.WriteString("dashboard:\n")
+		writeChanges(&b, d.Changes)
+	}
+	for _, p := range d.Panels {
+		if p.Kind != Changed {
+			fmt.Fprintf(&b, "panel %q: %s\n", p.Title, p.Kind)
+			continue
+		}
+		fmt.Fprintf(&b, "panel %q:\n", p.Title)
+		writeChanges(&b, p.Changes)
+	}
+	return b.String()
+}
+
+func writeChanges(b *strings.Builder, changes []Change) {
+	for _, c := range changes {
+		switch c.Kind {
+		case Added:
+			fmt.Fprintf(b, "  + %s: %s\n", c.Path, diffJSON(c.New))
+		case Removed:
+			fmt.Fprintf(b, "  - %s: %s\n", c.Path, diffJSON(c.Old))
+		default:
+			fmt.Fprintf(b, "  ~ %s: %s -> %s\n", c.Path, diffJSON(c.Old), diffJSON(c.New))
+		}
+	}
+}
+
+func diffJSON(v interface{}) string {
+	jsonBytes, _ := json.Marshal(v)
+	return string(jsonBytes)
+}
+
+// volatileFields are the dashboard fields which change on every saving, they are not compared.
+var volatileFields = []string{"id", "version", "iteration", renderedKey}
+
+// DiffDashboards returns the structural diff between the deployed and the rendered dashboard JSON.
+func DiffDashboards(deployed []byte, rendered []byte) (DashboardDiff, error) {
+	var deployedDashboard, renderedDashboard map[string]interface{}
+	if err := json.Unmarshal(deployed, &deployedDashboard); err != nil {
+		return DashboardDiff{}, err
+	}
+	if err := json.Unmarshal(rendered, &renderedDashboard); err != nil {
+		return DashboardDiff{}, err
+	}
+	return diffDashboards(deployedDashboard, renderedDashboard), nil
+}
+
+func diffDashboards(deployed map[string]interface{}, rendered map[string]interface{}) DashboardDiff {
+	deployed, deployedPanels := normalizeDashboard(deployed)
+	rendered, renderedPanels := normalizeDashboard(rendered)
+
+	var diff DashboardDiff
+	diffValues("", deployed, rendered, &diff.Changes)
+
+	deployedTitles, deployedByTitle := panelsByTitle(deployedPanels)
+	renderedTitles, renderedByTitle := panelsByTitle(renderedPanels)
+	for _, title := range deployedTitles {
+		if _, ok := renderedByTitle[title]; !ok {
+			diff.Panels = append(diff.Panels, PanelDiff{Title: title, Kind: Removed})
+		}
+	}
+	for _, title := range renderedTitles {
+		deployedPanel, ok := deployedByTitle[title]
+		if !ok {
+			diff.Panels = append(diff.Panels, PanelDiff{Title: title, Kind: Added})
+			continue
+		}
+		var changes []Change
+		diffValues("", deployedPanel, renderedByTitle[title], &changes)
+		if len(changes) > 0 {
+			diff.Panels = append(diff.Panels, PanelDiff{Title: title, Kind: Changed, Changes: changes})
+		}
+	}
+	return diff
+}
+
+// normalizeDashboard returns the copy of the dashboard without the volatile fields and the panels,
+// and the panels without their ids, including the panels of the collapsed rows.
+func normalizeDashboard(dashboard map[string]interface{}) (map[string]interface{}, []map[string]interface{}) {
+	normalized := make(map[string]interface{}, len(dashboard))
+	for k, v := range dashboard {
+		normalized[k] = v
+	}
+	for _, field := range volatileFields {
+		delete(normalized, field)
+	}
+	delete(normalized, "panels")
+
+	var panels []map[string]interface{}
+	for _, panel := range panelMaps(dashboard["panels"]) {
+		panels = append(panels, panel)
+		panels = append(panels, panelMaps(panel["panels"])...)
+	}
+	for i, panel := range panels {
+		p := make(map[string]interface{}, len(panel))
+		for k, v := range panel {
+			p[k] = v
+		}
+		delete(p, "id")
+		delete(p, "panels")
+		panels[i] = p
+	}
+	return normalized, panels
+}
+
+// panelsByTitle returns the panel titles in order, and the panels by title,
+// the panels with the same title are told apart by their occurrences, e.g. `CPU #2`.
+func panelsByTitle(panels []map[string]interface{}) ([]string, map[string]map[string]interface{}) {
+	titles := make([]string, 0, len(panels))
+	byTitle := make(map[string]map[string]interface{}, len(panels))
+	occurrences := make(map[string]int)
+	for _, panel := range panels {
+		title, _ := panel["title"].(string)
+		occurrences[title]++
+		if n := occurrences[title]; n > 1 {
+			title = fmt.Sprintf("%s #%d", title, n)
+		}
+		titles = append(titles, title)
+		byTitle[title] = panel
+	}
+	return titles, byTitle
+}
+
+// diffValues appends the changes between the JSON values to changes, the queries are matched by their refIds.
+func diffValues(path string, old interface{}, new interface{}, changes *[]Change) {
+	switch oldValue := old.(type) {
+	case map[string]interface{}:
+		newValue, ok := new.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(oldValue)+len(newValue))
+		for k := range oldValue {
+			keys = append(keys, k)
+		}
+		for k := range newValue {
+			if _, ok := oldValue[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			o, inOld := oldValue[k]
+			n, inNew := newValue[k]
+			switch {
+			case !inNew:
+				*changes = append(*changes, Change{Path: joinPath(path, k), Kind: Removed, Old: o})
+			case !inOld:
+				*changes = append(*changes, Change{Path: joinPath(path, k), Kind: Added, New: n})
+			default:
+				diffValues(joinPath(path, k), o, n, changes)
+			}
+		}
+		return
+	case []interface{}:
+		newValue, ok := new.([]interface{})
+		if !ok {
+			break
+		}
+		if oldKeys, newKeys, ok := refIDKeys(oldValue, newValue); ok {
+			diffValues(path, oldKeys, newKeys, changes)
+			return
+		}
+		for i := 0; i < len(oldValue) || i < len(newValue); i++ {
+			elemPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(newValue):
+				*changes = append(*changes, Change{Path: elemPath, Kind: Removed, Old: oldValue[i]})
+			case i >= len(oldValue):
+				*changes = append(*changes, Change{Path: elemPath, Kind: Added, New: newValue[i]})
+			default:
+				diffValues(elemPath, oldValue[i], newValue[i], changes)
+			}
+		}
+		return
+	}
+
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, Change{Path: path, Kind: Changed, Old: old, New: new})
+	}
+}
+
+// refIDKeys returns the queries by their refIds in the form of `[A]`, if all the elements are queries
+// with distinct refIds.
+func refIDKeys(old []interface{}, new []interface{}) (map[string]interface{}, map[string]interface{}, bool) {
+	byRefID := func(values []interface{}) (map[string]interface{}, bool) {
+		m := make(map[string]interface{}, len(values))
+		for _, v := range values {
+			query, _ := v.(map[string]interface{})
+			refID, ok := query["refId"].(string)
+			if !ok {
+				return nil, false
+			}
+			if _, ok := m["["+refID+"]"]; ok {
+				return nil, false
+			}
+			m["["+refID+"]"] = v
+		}
+		return m, true
+	}
+	if len(old) == 0 && len(new) == 0 {
+		return nil, nil, false
+	}
+	oldKeys, ok := byRefID(old)
+	if !ok {
+		return nil, nil, false
+	}
+	newKeys, ok := byRefID(new)
+	if !ok {
+		return nil, nil, false
+	}
+	return oldKeys, newKeys, true
+}
+
+// joinPath joins the path of JSON value with the key, the keys of the queries are already in the form of `[A]`.
+func joinPath(path string, key string) string {
+	if path == "" || strings.HasPrefix(key, "[") {
+		return path + key
+	}
+	return path + "." + key
+}
+
+// RenderedDiff is the diff between the deployed dashboard and the dashboard rendered from the template.
+type RenderedDiff struct {
+	Rendered RenderedDashboard
+	// Deployed tells if the rendered dashboard is deployed, all the panels are added if it's not.
+	Deployed bool
+	Diff     DashboardDiff
+}
+
+// DiffRenderedDashboards renders the dashboards of the templates from the source, and compares them to
+// the dashboards deployed in Grafana, which are found by the rendered UIDs or titles.
+func DiffRenderedDashboards(config UpdateConfig, source TemplateSource, vars RenderVars) ([]RenderedDiff, error) {
+	rendered, err := RenderTemplates(config, source, vars)
+	if err != nil {
+		return nil, err
+	}
+
+	cli, err := newAPIClient(config)
+	if err != nil {
+		return nil, err
+	}
+	diffs := make([]RenderedDiff, 0, len(rendered))
+	for _, r := range rendered {
+		var renderedDashboard map[string]interface{}
+		if err := json.Unmarshal(r.Dashboard, &renderedDashboard); err != nil {
+			return nil, err
+		}
+		title, _ := renderedDashboard["title"].(string)
+		saved, err := findDashboard(context.Background(), cli, r.UID, title)
+		if err != nil {
+			return nil, err
+		}
+
+		deployed := map[string]interface{}{}
+		if saved != nil {
+			deployed = saved.Dashboard
+		}
+		diffs = append(diffs, RenderedDiff{
+			Rendered: r,
+			Deployed: saved != nil,
+			Diff:     diffDashboards(deployed, renderedDashboard),
+		})
+	}
+	return diffs, nil
+}
+
+// findDashboard fetches the dashboard by UID, or by title if there is no dashboard of the UID.
+// It returns nil if neither exists.
+func findDashboard(ctx context.Context, cli *apiClient, uid string, title string) (*savedDashboard, error) {
+	saved, err := getDashboard(ctx, cli, uid)
+	if err != nil || saved != nil || title == "" {
+		return saved, err
+	}
+
+	var results []struct {
+		UID   string `json:"uid"`
+		Title string `json:"title"`
+	}
+	query := url.Values{"type": {"dash-db"}, "query": {title}}
+	if err := cli.do(ctx, http.MethodGet, "/api/search?"+query.Encode(), nil, &results); err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, r := range results {
+		if r.Title == title {
+			found = append(found, r.UID)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, nil
+	case 1:
+		return getDashboard(ctx, cli, found[0])
+	default:
+		return nil, fmt.Errorf("%d dashboards are titled %q", len(found), title)
+	}
+}
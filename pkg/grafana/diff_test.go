@@ -0,0 +1,116 @@
+package grafana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const deployedDashboard = `{
+  "id": 12, "uid": "rendered", "version": 3, "iteration": 1650000000, "title": "svc",
+  "panels": [
+    {"id": 1, "title": "latency", "gridPos": {"h": 8, "w": 12, "x": 0, "y": 0},
+     "targets": [{"refId": "A", "expr": "latency"}, {"refId": "B", "expr": "errors"}]},
+    {"id": 2, "title": "cpu", "gridPos": {"h": 8, "w": 12, "x": 12, "y": 0}},
+    {"id": 3, "type": "row", "title": "old", "collapsed": true,
+     "panels": [{"id": 4, "title": "memory", "alert": {"name": "memory"}}]}
+  ]
+}`
+
+func TestDiffDashboards(t *testing.T) {
+	diff, err := DiffDashboards([]byte(deployedDashboard), []byte(deployedDashboard))
+	assert.Nil(t, err)
+	assert.True(t, diff.Empty())
+
+	// the volatile fields and the panel ids are ignored
+	diff, err = DiffDashboards([]byte(deployedDashboard), []byte(`{
+  "uid": "rendered", "title": "svc",
+  "panels": [
+    {"id": 5, "title": "latency", "gridPos": {"h": 8, "w": 12, "x": 0, "y": 0},
+     "targets": [{"refId": "B", "expr": "errors"}, {"refId": "A", "expr": "latency"}]},
+    {"id": 6, "title": "cpu", "gridPos": {"h": 8, "w": 12, "x": 12, "y": 0}},
+    {"id": 7, "type": "row", "title": "old", "collapsed": true,
+     "panels": [{"id": 8, "title": "memory", "alert": {"name": "memory"}}]}
+  ]
+}`))
+	assert.Nil(t, err)
+	assert.True(t, diff.Empty())
+
+	diff, err = DiffDashboards([]byte(deployedDashboard), []byte(`{
+  "uid": "rendered", "title": "svc v2",
+  "panels": [
+    {"id": 1, "title": "latency", "gridPos": {"h": 8, "w": 24, "x": 0, "y": 0},
+     "targets": [{"refId": "A", "expr": "latency_seconds"}, {"refId": "C", "expr": "saturation"}]},
+    {"id": 2, "type": "row", "title": "old", "collapsed": true,
+     "panels": [{"id": 3, "title": "memory"}]},
+    {"id": 4, "title": "disk"}
+  ]
+}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Path: "title", Kind: Changed, Old: "svc", New: "svc v2"}}, diff.Changes)
+	assert.Equal(t, []PanelDiff{
+		{Title: "cpu", Kind: Removed},
+		{Title: "latency", Kind: Changed, Changes: []Change{
+			{Path: "gridPos.w", Kind: Changed, Old: float64(12), New: float64(24)},
+			{Path: "targets[A].expr", Kind: Changed, Old: "latency", New: "latency_seconds"},
+			{Path: "targets[B]", Kind: Removed, Old: map[string]interface{}{"refId": "B", "expr": "errors"}},
+			{Path: "targets[C]", Kind: Added, New: map[string]interface{}{"refId": "C", "expr": "saturation"}},
+		}},
+		{Title: "memory", Kind: Changed, Changes: []Change{
+			{Path: "alert", Kind: Removed, Old: map[string]interface{}{"name": "memory"}},
+		}},
+		{Title: "disk", Kind: Added},
+	}, diff.Panels)
+
+	assert.Equal(t, `dashboard:
+  ~ title: "svc" -> "svc v2"
+panel "cpu": removed
+panel "latency":
+  ~ gridPos.w: 12 -> 24
+  ~ targets[A].expr: "latency" -> "latency_seconds"
+  - targets[B]: {"expr":"errors","refId":"B"}
+  + targets[C]: {"expr":"saturation","refId":"C"}
+panel "memory":
+  - alert: {"name":"memory"}
+panel "disk": added
+`, diff.String())
+}
+
+func TestDiffRenderedDashboards(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"svc.json": `{"uid": "svc", "title": "$SERVICE_NAME", "panels": [{"id": 1, "title": "latency"}]}`,
+	})
+	defer os.RemoveAll(dir)
+	vars := RenderVars{{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}}}}
+
+	// the dashboard isn't deployed by the rendered UID, but it's found by the title
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/api/search" && req.URL.Query().Get("query") == "news":
+			_, _ = w.Write([]byte(`[{"uid": "legacy", "title": "news"}, {"uid": "other", "title": "news v1"}]`))
+		case req.URL.Path == "/api/search":
+			_, _ = w.Write([]byte(`[]`))
+		case req.URL.Path == "/api/dashboards/uid/legacy":
+			_, _ = w.Write([]byte(`{"dashboard": {"uid": "legacy", "title": "news", "panels": [{"id": 7, "title": "cpu"}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	diffs, err := DiffRenderedDashboards(UpdateConfig{APIUrl: server.URL}, NewFileTemplateSource(dir), vars)
+	assert.Nil(t, err)
+	assert.Len(t, diffs, 1)
+	assert.True(t, diffs[0].Deployed)
+	assert.Equal(t, []Change{{Path: "uid", Kind: Changed, Old: "legacy", New: diffs[0].Rendered.UID}},
+		diffs[0].Diff.Changes)
+	assert.Equal(t, []PanelDiff{{Title: "cpu", Kind: Removed}, {Title: "latency", Kind: Added}}, diffs[0].Diff.Panels)
+
+	vars[0].Values[0].Value = "payment"
+	diffs, err = DiffRenderedDashboards(UpdateConfig{APIUrl: server.URL}, NewFileTemplateSource(dir), vars)
+	assert.Nil(t, err)
+	assert.False(t, diffs[0].Deployed)
+}
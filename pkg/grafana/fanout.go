@@ -0,0 +1,175 @@
+package grafana
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// FanOutConfig renders a dashboard for each value of the var, instead of repeating the rows in one dashboard.
+type FanOutConfig struct {
+	Var string `json:"var"`
+	// Title, UID, Folder and FolderTitle are the patterns of the title, the UID, the folder UID and the folder
+	// title of the dashboards in the Go template syntax, the variables are the fields, e.g. `{{.SERVICE_NAME}} monitoring`.
+	// The title defaults to the rendered title, the UID is derived from the value by default,
+	// and the folder defaults to FolderUID or FolderTitle. The dashboards in one folder need different titles.
+	Title       string `json:"title"`
+	UID         string `json:"uid"`
+	Folder      string `json:"folder"`
+	FolderTitle string `json:"folderTitle"`
+}
+
+// renderTarget is a dashboard rendered from the template with its config and variables.
+type renderTarget struct {
+	// name tells the dashboard from the others rendered from the same template, it's the fan-out value.
+	name   string
+	config UpdateConfig
+	vars   RenderVars
+}
+
+// renderTargets returns the dashboards to render from a template, there is one for each value of the fan-out var,
+// or only one if the config doesn't fan out.
+func renderTargets(config UpdateConfig, vars RenderVars) ([]renderTarget, error) {
+	fanOut := config.FanOut
+	if fanOut.Var == "" {
+		return []renderTarget{{config: config, vars: vars}}, nil
+	}
+	if len(config.AlertRules.Rules) > 0 {
+		return nil, errors.New("the alert rules can't be rendered for the fan-out dashboards")
+	}
+	v, ok := vars.getVar(fanOut.Var)
+	if !ok {
+		return nil, fmt.Errorf("the fan-out var %s isn't defined", fanOut.Var)
+	}
+
+	targets := make([]renderTarget, 0, len(v.Values))
+	uids := make(map[string]string, len(v.Values))
+	for _, val := range v.Values {
+		target, err := fanOutTarget(config, vars, val)
+		if err != nil {
+			return nil, err
+		}
+		uid := target.config.RenderedDashboardUID()
+		if other, ok := uids[uid]; ok {
+			return nil, fmt.Errorf("the fan-out values %s and %s have the same dashboard UID %q", other, target.name, uid)
+		}
+		uids[uid] = target.name
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// checkTargetTitles makes sure the dashboards rendered from the template for the fan-out values have different
+// titles in each folder, Grafana doesn't save a dashboard with the title of another one in the folder.
+func checkTargetTitles(tmpl Template, fanOutVar string, targets []renderTarget) error {
+	if len(targets) < 2 {
+		return nil
+	}
+	type folderTitle struct {
+		folder, folderTitle, title string
+	}
+	names := make(map[folderTitle]string, len(targets))
+	for _, target := range targets {
+		rendered, err := renderTemplate(templateConfig(target.config, tmpl), tmpl, target.name, target.vars, 0)
+		if err != nil {
+			return err
+		}
+		var dashboard struct {
+			Title string `json:"title"`
+		}
+		if err := json.Unmarshal(rendered.Dashboard, &dashboard); err != nil {
+			return err
+		}
+		key := folderTitle{target.config.FolderUID, target.config.FolderTitle, dashboard.Title}
+		if other, ok := names[key]; ok {
+			return fmt.Errorf("the fan-out values %s and %s have the same dashboard title %q in one folder, "+
+				"give a fan-out title referring to %s", other, target.name, dashboard.Title, fanOutVar)
+		}
+		names[key] = target.name
+	}
+	return nil
+}
+
+// fanOutTarget returns the dashboard rendered for the value of the fan-out var, the vars and the context of
+// the value override the other vars in the whole dashboard.
+func fanOutTarget(config UpdateConfig, vars RenderVars, val Val) (renderTarget, error) {
+	fanOut := config.FanOut
+	value := val.Value
+	if len(val.Values) > 0 {
+		value = strings.Join(val.Values, "+")
+	}
+
+	targetVars := make(RenderVars, 0, len(vars))
+	for _, v := range vars {
+		if v.Name == fanOut.Var {
+			v.Values = []Val{{Value: val.Value, Values: val.Values}}
+		} else if ctxValue, ok := val.Context[v.Name]; ok {
+			v.Values = []Val{{Value: ctxValue}}
+		} else if nested, ok := val.Vars.getVar(v.Name); ok {
+			v = nested
+		}
+		targetVars = append(targetVars, v)
+	}
+	for _, nested := range val.Vars {
+		if _, ok := targetVars.getVar(nested.Name); !ok {
+			targetVars = append(targetVars, nested)
+		}
+	}
+
+	data := patternData(targetVars)
+	targetConfig := config
+	targetConfig.FanOut = FanOutConfig{}
+	if config.Name != "" {
+		targetConfig.Name = config.Name + "/" + value
+	} else {
+		targetConfig.Name = value
+	}
+	for _, p := range []struct {
+		pattern string
+		field   *string
+	}{
+		{fanOut.Title, &targetConfig.Title},
+		{fanOut.UID, &targetConfig.RenderedUID},
+		{fanOut.Folder, &targetConfig.FolderUID},
+		{fanOut.FolderTitle, &targetConfig.FolderTitle},
+	} {
+		if p.pattern == "" {
+			continue
+		}
+		executed, err := executePattern(p.pattern, data)
+		if err != nil {
+			return renderTarget{}, err
+		}
+		*p.field = executed
+	}
+	return renderTarget{name: value, config: targetConfig, vars: targetVars}, nil
+}
+
+// patternData returns the data of the patterns, the first value of each var, or the values of a set joined by `+`.
+func patternData(vars RenderVars) map[string]string {
+	data := make(map[string]string, len(vars))
+	for _, v := range vars {
+		if len(v.Values) > 0 {
+			data[v.Name] = v.Values[0].Value
+			if len(v.Values[0].Values) > 0 {
+				data[v.Name] = strings.Join(v.Values[0].Values, "+")
+			}
+		}
+	}
+	return data
+}
+
+// executePattern executes the Go template pattern with the data, it fails if the pattern refers to a missing var.
+func executePattern(pattern string, data map[string]string) (string, error) {
+	tmpl, err := template.New("pattern").Option("missingkey=error").Parse(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern %q: %w", pattern, err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("fail to execute the pattern %q: %w", pattern, err)
+	}
+	return b.String(), nil
+}
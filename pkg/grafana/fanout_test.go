@@ -0,0 +1,123 @@
+package grafana
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fanOutTemplate = `{"uid": "svc", "title": "$SERVICE_NAME", "panels": [
+  {"type": "row", "id": 1, "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "graph", "id": 2, "title": "$SERVICE_NAME in $ENV", "gridPos": {"h": 8, "w": 24, "x": 0, "y": 1}}
+]}`
+
+var fanOutVars = RenderVars{
+	{Name: "SERVICE_NAME", Values: []Val{
+		{Value: "news", Context: map[string]string{"ENV": "staging"}},
+		{Value: "payment"},
+	}},
+	{Name: "ENV", Values: []Val{{Value: "prod"}}},
+}
+
+func TestRenderTemplatesFanOut(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{"svc.json": fanOutTemplate})
+	defer os.RemoveAll(dir)
+
+	config := UpdateConfig{FanOut: FanOutConfig{
+		Var:    "SERVICE_NAME",
+		Title:  "{{.SERVICE_NAME}} monitoring",
+		Folder: "team-{{.SERVICE_NAME}}",
+	}}
+	rendered, err := RenderTemplates(config, NewFileTemplateSource(dir), fanOutVars)
+	assert.Nil(t, err)
+	assert.Len(t, rendered, 2)
+
+	for i, expected := range []struct {
+		name       string
+		title      string
+		panelTitle string
+	}{
+		{"svc-news", "news monitoring", "news in staging"},
+		{"svc-payment", "payment monitoring", "payment in prod"},
+	} {
+		assert.Equal(t, expected.name, rendered[i].Name)
+
+		var dashboard map[string]interface{}
+		assert.Nil(t, json.Unmarshal(rendered[i].Dashboard, &dashboard))
+		assert.Equal(t, expected.title, dashboard["title"])
+		assert.Equal(t, rendered[i].UID, dashboard["uid"])
+
+		// the row is repeated only by the value of the dashboard
+		panels := dashboard["panels"].([]interface{})
+		assert.Len(t, panels, 2)
+		assert.Equal(t, expected.panelTitle, panels[1].(map[string]interface{})["title"])
+	}
+	assert.NotEqual(t, rendered[0].UID, rendered[1].UID)
+
+	targets, err := renderTargets(config, fanOutVars)
+	assert.Nil(t, err)
+	assert.Equal(t, "team-news", targets[0].config.FolderUID)
+	assert.Equal(t, "news", targets[0].config.Name)
+}
+
+func TestRenderTargetsFanOutErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fanOut FanOutConfig
+	}{
+		{"undefined var", FanOutConfig{Var: "TEAM"}},
+		{"same UIDs", FanOutConfig{Var: "SERVICE_NAME", UID: "{{.ENV}}"}},
+		{"missing field", FanOutConfig{Var: "SERVICE_NAME", Title: "{{.TEAM}}"}},
+		{"invalid pattern", FanOutConfig{Var: "SERVICE_NAME", Title: "{{.SERVICE_NAME"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			vars := RenderVars{fanOutVars[0], {Name: "ENV", Values: []Val{{Value: "prod"}}}}
+			vars[0].Values = []Val{{Value: "news"}, {Value: "payment"}}
+			_, err := renderTargets(UpdateConfig{FanOut: test.fanOut}, vars)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+func TestRenderTargetsFanOutNestedVars(t *testing.T) {
+	vars := RenderVars{
+		{Name: "REGION", Values: []Val{
+			{Value: "eu", Vars: RenderVars{
+				{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}},
+				{Name: "ENV", Values: []Val{{Value: "staging"}}},
+			}},
+			{Value: "us"},
+		}},
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "user"}}},
+	}
+	targets, err := renderTargets(UpdateConfig{FanOut: FanOutConfig{Var: "REGION"}}, vars)
+	assert.Nil(t, err)
+	assert.Len(t, targets, 2)
+	assert.Equal(t, RenderVars{
+		{Name: "REGION", Values: []Val{{Value: "eu"}}},
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}},
+		{Name: "ENV", Values: []Val{{Value: "staging"}}},
+	}, targets[0].vars)
+	assert.Equal(t, RenderVars{
+		{Name: "REGION", Values: []Val{{Value: "us"}}},
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "user"}}},
+	}, targets[1].vars)
+}
+
+func TestRenderTemplatesFanOutSameTitle(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{"svc.json": `{"uid": "svc", "title": "services", "panels": []}`})
+	defer os.RemoveAll(dir)
+	vars := RenderVars{{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}}}
+
+	_, err := RenderTemplates(UpdateConfig{FanOut: FanOutConfig{Var: "SERVICE_NAME"}}, NewFileTemplateSource(dir), vars)
+	assert.NotNil(t, err)
+
+	// the same title in different folders
+	config := UpdateConfig{FanOut: FanOutConfig{Var: "SERVICE_NAME", Folder: "team-{{.SERVICE_NAME}}"}}
+	rendered, err := RenderTemplates(config, NewFileTemplateSource(dir), vars)
+	assert.Nil(t, err)
+	assert.Len(t, rendered, 2)
+}
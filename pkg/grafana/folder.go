@@ -0,0 +1,191 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// folderPermissions are the permission levels of the folders by name.
+var folderPermissions = map[string]int{"View": 1, "Edit": 2, "Admin": 4}
+
+// FolderPermission grants the permission, `View`, `Edit` or `Admin`, of the folder to a role, a team or a user.
+type FolderPermission struct {
+	// Role is the organization role, `Viewer` or `Editor`.
+	Role       string `json:"role"`
+	TeamID     int    `json:"teamId"`
+	UserID     int    `json:"userId"`
+	Permission string `json:"permission"`
+}
+
+// folder is a folder in Grafana.
+type folder struct {
+	ID    int    `json:"id"`
+	UID   string `json:"uid"`
+	Title string `json:"title"`
+}
+
+// targetFolderID returns the ID of the folder of the rendered dashboard by FolderUID or FolderTitle.
+// The folder is created if it doesn't exist and CreateFolder is set, and its permissions are replaced
+// if FolderPermissions are given.
+func targetFolderID(ctx context.Context, cli *apiClient, config UpdateConfig) (int, error) {
+	name := config.FolderUID
+	if name == "" {
+		name = config.FolderTitle
+	}
+
+	var (
+		path = splitFolderPath(config.FolderTitle)
+		f    *folder
+		err  error
+	)
+	if config.FolderUID != "" {
+		f, err = getFolder(ctx, cli, config.FolderUID)
+		if err == nil && f == nil && config.CreateFolder {
+			title := config.FolderUID
+			parent := &folder{}
+			if len(path) > 0 {
+				title = path[len(path)-1]
+				parent, err = folderByPath(ctx, cli, path[:len(path)-1], true)
+			}
+			if err == nil {
+				f, err = createFolder(ctx, cli, config.FolderUID, title, parent.UID)
+				if err != nil {
+					// it could be created by another job in the meantime
+					if f, _ = getFolder(ctx, cli, config.FolderUID); f != nil {
+						err = nil
+					}
+				}
+			}
+		}
+	} else {
+		f, err = folderByPath(ctx, cli, path, config.CreateFolder)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("fail to get the folder %s: %w", name, err)
+	}
+	if f == nil {
+		return 0, fmt.Errorf("folder %s doesn't exist", name)
+	}
+
+	if len(config.FolderPermissions) > 0 {
+		if err := setFolderPermissions(ctx, cli, f.UID, config.FolderPermissions); err != nil {
+			return 0, fmt.Errorf("fail to set the permissions of the folder %s: %w", name, err)
+		}
+	}
+	return f.ID, nil
+}
+
+// splitFolderPath returns the titles of the folders in the path, e.g. `Teams/News`.
+func splitFolderPath(path string) []string {
+	var titles []string
+	for _, title := range strings.Split(path, "/") {
+		if title = strings.TrimSpace(title); title != "" {
+			titles = append(titles, title)
+		}
+	}
+	return titles
+}
+
+// getFolder returns the folder by UID, or nil if it doesn't exist.
+func getFolder(ctx context.Context, cli *apiClient, uid string) (*folder, error) {
+	var f folder
+	if err := cli.do(ctx, http.MethodGet, "/api/folders/"+url.PathEscape(uid), nil, &f); err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &f, nil
+}
+
+// folderByPath returns the folder by the titles of the path from the top level, or nil if it doesn't exist,
+// the missing folders are created if create is set. Nested folders need Grafana 10+.
+func folderByPath(ctx context.Context, cli *apiClient, path []string, create bool) (*folder, error) {
+	parent := &folder{}
+	for _, title := range path {
+		f, err := findFolder(ctx, cli, title, parent.UID)
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			if !create {
+				return nil, nil
+			}
+			if f, err = createFolder(ctx, cli, "", title, parent.UID); err != nil {
+				// it could be created by another job in the meantime
+				if f, _ = findFolder(ctx, cli, title, parent.UID); f == nil {
+					return nil, err
+				}
+			}
+		}
+		parent = f
+	}
+	return parent, nil
+}
+
+// findFolder returns the folder by title in the parent folder, or nil if it doesn't exist.
+func findFolder(ctx context.Context, cli *apiClient, title string, parentUID string) (*folder, error) {
+	query := url.Values{"limit": {"1000"}}
+	if parentUID != "" {
+		query.Set("parentUid", parentUID)
+	}
+	var folders []folder
+	if err := cli.do(ctx, http.MethodGet, "/api/folders?"+query.Encode(), nil, &folders); err != nil {
+		return nil, err
+	}
+	for _, f := range folders {
+		if f.Title == title {
+			return &f, nil
+		}
+	}
+	return nil, nil
+}
+
+// createFolder creates the folder in the parent folder, the UID is generated by Grafana if it's empty.
+func createFolder(ctx context.Context, cli *apiClient, uid string, title string, parentUID string) (*folder, error) {
+	body := map[string]string{"title": title}
+	if uid != "" {
+		body["uid"] = uid
+	}
+	if parentUID != "" {
+		body["parentUid"] = parentUID
+	}
+	var f folder
+	if err := cli.do(ctx, http.MethodPost, "/api/folders", body, &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// setFolderPermissions replaces the permissions of the folder.
+func setFolderPermissions(ctx context.Context, cli *apiClient, uid string, permissions []FolderPermission) error {
+	type item struct {
+		Role       string `json:"role,omitempty"`
+		TeamID     int    `json:"teamId,omitempty"`
+		UserID     int    `json:"userId,omitempty"`
+		Permission int    `json:"permission"`
+	}
+	items := make([]item, 0, len(permissions))
+	for _, p := range permissions {
+		level, ok := folderPermissions[p.Permission]
+		if !ok {
+			return fmt.Errorf("unknown permission %q, it should be View, Edit or Admin", p.Permission)
+		}
+		given := 0
+		for _, set := range []bool{p.Role != "", p.TeamID != 0, p.UserID != 0} {
+			if set {
+				given++
+			}
+		}
+		if given != 1 {
+			return errors.New("a permission is granted to exactly one of a role, a team or a user")
+		}
+		items = append(items, item{Role: p.Role, TeamID: p.TeamID, UserID: p.UserID, Permission: level})
+	}
+	return cli.do(ctx, http.MethodPost, "/api/folders/"+url.PathEscape(uid)+"/permissions",
+		map[string]interface{}{"items": items}, nil)
+}
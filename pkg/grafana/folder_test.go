@@ -0,0 +1,140 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeFoldersAPI is a stand-in of the folders API of Grafana 10+ with the nested folders.
+type fakeFoldersAPI struct {
+	sync.Mutex
+	folders     []map[string]interface{}
+	permissions map[string]interface{}
+}
+
+func (f *fakeFoldersAPI) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/api/folders":
+		children := []map[string]interface{}{}
+		for _, folder := range f.folders {
+			if folder["parentUid"] == req.URL.Query().Get("parentUid") {
+				children = append(children, folder)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(children)
+	case req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/api/folders/"):
+		for _, folder := range f.folders {
+			if folder["uid"] == strings.TrimPrefix(req.URL.Path, "/api/folders/") {
+				_ = json.NewEncoder(w).Encode(folder)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	case req.Method == http.MethodPost && req.URL.Path == "/api/folders":
+		var folder map[string]interface{}
+		body, _ := ioutil.ReadAll(req.Body)
+		_ = json.Unmarshal(body, &folder)
+		if folder["uid"] == nil {
+			folder["uid"] = "f" + strconv.Itoa(len(f.folders)+1)
+		}
+		if folder["parentUid"] == nil {
+			folder["parentUid"] = ""
+		}
+		folder["id"] = len(f.folders) + 1
+		f.folders = append(f.folders, folder)
+		_ = json.NewEncoder(w).Encode(folder)
+	case req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/permissions"):
+		body, _ := ioutil.ReadAll(req.Body)
+		var permissions map[string]interface{}
+		_ = json.Unmarshal(body, &permissions)
+		f.permissions[strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/api/folders/"), "/permissions")] = permissions
+		_, _ = w.Write([]byte(`{"message": "Folder permissions updated"}`))
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestTargetFolderID(t *testing.T) {
+	api := &fakeFoldersAPI{
+		folders: []map[string]interface{}{
+			{"id": 1, "uid": "teams", "title": "Teams", "parentUid": ""},
+		},
+		permissions: make(map[string]interface{}),
+	}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL})
+	assert.Nil(t, err)
+
+	tests := []struct {
+		name     string
+		config   UpdateConfig
+		expected int
+	}{
+		{"by UID", UpdateConfig{FolderUID: "teams"}, 1},
+		{"by title", UpdateConfig{FolderTitle: "Teams"}, 1},
+		{"nested path", UpdateConfig{FolderTitle: "Teams/News", CreateFolder: true}, 2},
+		{"existing nested path", UpdateConfig{FolderTitle: " Teams / News "}, 2},
+		{"new UID in path", UpdateConfig{FolderUID: "payment", FolderTitle: "Teams/Payment", CreateFolder: true}, 3},
+		{"new UID", UpdateConfig{FolderUID: "user", CreateFolder: true}, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id, err := targetFolderID(context.Background(), cli, test.config)
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, id)
+		})
+	}
+	assert.Len(t, api.folders, 4)
+	assert.Equal(t, "teams", api.folders[1]["parentUid"])
+	assert.Equal(t, map[string]interface{}{"uid": "payment", "title": "Payment", "parentUid": "teams", "id": 3},
+		api.folders[2])
+	assert.Equal(t, "user", api.folders[3]["title"])
+
+	_, err = targetFolderID(context.Background(), cli, UpdateConfig{FolderTitle: "Teams/Search"})
+	assert.NotNil(t, err)
+	_, err = targetFolderID(context.Background(), cli, UpdateConfig{FolderUID: "search"})
+	assert.NotNil(t, err)
+	assert.Len(t, api.folders, 4)
+}
+
+func TestTargetFolderPermissions(t *testing.T) {
+	api := &fakeFoldersAPI{permissions: make(map[string]interface{})}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL})
+	assert.Nil(t, err)
+
+	config := UpdateConfig{FolderUID: "news", CreateFolder: true, FolderPermissions: []FolderPermission{
+		{Role: "Viewer", Permission: "View"},
+		{TeamID: 3, Permission: "Edit"},
+	}}
+	_, err = targetFolderID(context.Background(), cli, config)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"items": []interface{}{
+		map[string]interface{}{"role": "Viewer", "permission": float64(1)},
+		map[string]interface{}{"teamId": float64(3), "permission": float64(2)},
+	}}, api.permissions["news"])
+
+	for _, permission := range []FolderPermission{
+		{Role: "Viewer", Permission: "Read"},
+		{Role: "Viewer", UserID: 2, Permission: "View"},
+		{Permission: "View"},
+	} {
+		config.FolderPermissions = []FolderPermission{permission}
+		_, err = targetFolderID(context.Background(), cli, config)
+		assert.NotNil(t, err, "%+v", permission)
+	}
+}
@@ -0,0 +1,368 @@
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+// formatter formats the values of a variable, a single-valued variable has exactly
+// one value and multi is false, a multi-valued variable could have any number of values.
+type formatter func(name string, values []string, multi bool) string
+
+// formatters are the advanced variable format options of Grafana,
+// see https://grafana.com/docs/grafana/latest/variables/advanced-variable-format-options/
+var formatters = map[string]formatter{
+	"csv":           formatCSV,
+	"distributed":   formatDistributed,
+	"doublequote":   formatDoubleQuote,
+	"glob":          formatGlob,
+	"json":          formatJSON,
+	"lucene":        formatLucene,
+	"percentencode": formatPercentEncode,
+	"pipe":          formatPipe,
+	"queryparam":    formatQueryParam,
+	"raw":           formatRaw,
+	"regex":         formatRegex,
+	"singlequote":   formatSingleQuote,
+	"sqlstring":     formatSQLString,
+	"text":          formatText,
+}
+
+// formatValue formats the values of the variable with the format option,
+// the unknown or empty format falls back to glob like Grafana does.
+func formatValue(name string, values []string, multi bool, format string) string {
+	f, ok := formatters[format]
+	if !ok {
+		f = formatGlob
+	}
+	return f(name, values, multi)
+}
+
+// defaultFormatter returns how a variable is formatted without the format option, it follows the
+// interpolateVariable of the Grafana datasource plugins, multi is true if the variable is a set or
+// the template variable is multi-value or includes "All".
+func defaultFormatter(datasource string, multi bool) formatter {
+	switch datasource {
+	case "prometheus", "loki":
+		if multi {
+			return formatPrometheusRegex
+		}
+		return formatPrometheus
+	case "influxdb":
+		if multi {
+			return formatInfluxRegex
+		}
+		return formatRaw
+	case "elasticsearch":
+		if multi {
+			return formatLucene
+		}
+		return formatRaw
+	case "mysql", "postgres", "grafana-postgresql-datasource", "mssql":
+		if multi {
+			return formatSQLString
+		}
+		return formatRaw
+	}
+	return formatGlob
+}
+
+// datasourceType returns the plugin type of the datasource field of a panel or a target, the datasources
+// referred to by the name, the UID, an input or a datasource variable are looked up in the types by the reference.
+// It's empty if the type isn't known.
+func datasourceType(datasource interface{}, types map[string]string) string {
+	switch ds := datasource.(type) {
+	case string:
+		if t, ok := types[ds]; ok {
+			return t
+		}
+		// the keys of the configuration file are lowercased
+		return types[strings.ToLower(ds)]
+	case map[string]interface{}:
+		if t, _ := ds["type"].(string); t != "" {
+			return t
+		}
+		uid, _ := ds["uid"].(string)
+		return types[uid]
+	}
+	return ""
+}
+
+// datasourceTypes returns the plugin types of the datasources the dashboard refers to by the reference,
+// they are the given types, the inputs of the exported dashboard, e.g. `${DS_PROMETHEUS}`, and the datasource
+// variables, e.g. `$datasource`.
+func datasourceTypes(dashboard *simplejson.Json, given map[string]string) map[string]string {
+	types := make(map[string]string, len(given))
+	add := func(name string, pluginID string) {
+		if name == "" || pluginID == "" {
+			return
+		}
+		for _, ref := range []string{"$" + name, "${" + name + "}", "[[" + name + "]]"} {
+			types[ref] = pluginID
+		}
+	}
+	for i := range dashboard.Get("__inputs").MustArray() {
+		input := dashboard.Get("__inputs").GetIndex(i)
+		if input.Get("type").MustString() == "datasource" {
+			add(input.Get("name").MustString(), input.Get("pluginId").MustString())
+		}
+	}
+	for _, t := range templateVariableList(dashboard) {
+		if pluginID, ok := t.Query.(string); ok && t.Type == "datasource" {
+			add(t.Name, pluginID)
+		}
+	}
+	for ref, t := range given {
+		types[ref] = t
+	}
+	return types
+}
+
+// unknownDatasources returns the references of the datasources in the dashboard whose types aren't known.
+func unknownDatasources(dashboard *simplejson.Json, types map[string]string) []string {
+	var unknown []string
+	seen := make(map[string]bool)
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch val := v.(type) {
+		case map[string]interface{}:
+			if ds, ok := val["datasource"]; ok && ds != nil && datasourceType(ds, types) == "" {
+				ref, _ := ds.(string)
+				if m, ok := ds.(map[string]interface{}); ok {
+					ref, _ = m["uid"].(string)
+				}
+				if ref != "" && !seen[ref] {
+					seen[ref] = true
+					unknown = append(unknown, ref)
+				}
+			}
+			for _, item := range val {
+				walk(item)
+			}
+		case []interface{}:
+			for _, item := range val {
+				walk(item)
+			}
+		}
+	}
+	walk(dashboard.Get("panels").Interface())
+	return unknown
+}
+
+func formatCSV(_ string, values []string, _ bool) string {
+	return strings.Join(values, ",")
+}
+
+func formatDistributed(name string, values []string, multi bool) string {
+	if !multi {
+		return strings.Join(values, ",")
+	}
+	distributed := make([]string, len(values))
+	for i, v := range values {
+		if i == 0 {
+			distributed[i] = v
+		} else {
+			distributed[i] = name + "=" + v
+		}
+	}
+	return strings.Join(distributed, ",")
+}
+
+func formatDoubleQuote(_ string, values []string, _ bool) string {
+	return quoteEach(values, `"`, `\"`)
+}
+
+func formatGlob(_ string, values []string, multi bool) string {
+	if multi && len(values) > 1 {
+		return "{" + strings.Join(values, ",") + "}"
+	}
+	return strings.Join(values, ",")
+}
+
+// formatInfluxRegex formats the set of values as the regex like the InfluxDB datasource, even a set of one value.
+func formatInfluxRegex(_ string, values []string, multi bool) string {
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		escaped[i] = regexEscape(v)
+	}
+	if !multi {
+		return strings.Join(escaped, ",")
+	}
+	return "(" + strings.Join(escaped, "|") + ")"
+}
+
+func formatJSON(_ string, values []string, multi bool) string {
+	var v interface{} = values
+	if !multi {
+		v = strings.Join(values, ",")
+	} else if values == nil {
+		v = []string{}
+	}
+
+	// JSON.stringify doesn't escape HTML characters
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(v)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func formatLucene(_ string, values []string, multi bool) string {
+	if !multi {
+		return luceneEscape(strings.Join(values, ","))
+	}
+	if len(values) == 0 {
+		return "__empty__"
+	}
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = `"` + luceneEscape(v) + `"`
+	}
+	return "(" + strings.Join(quoted, " OR ") + ")"
+}
+
+func formatPercentEncode(_ string, values []string, multi bool) string {
+	if multi {
+		return encodeURIComponent("{" + strings.Join(values, ",") + "}")
+	}
+	return encodeURIComponent(strings.Join(values, ","))
+}
+
+func formatPipe(_ string, values []string, _ bool) string {
+	return strings.Join(values, "|")
+}
+
+func formatPrometheus(_ string, values []string, _ bool) string {
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		escaped[i] = strings.NewReplacer(`\`, `\\`, `'`, `\\'`).Replace(v)
+	}
+	return strings.Join(escaped, ",")
+}
+
+func formatPrometheusRegex(_ string, values []string, multi bool) string {
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		escaped[i] = prometheusRegexEscape(v)
+	}
+	if !multi || len(escaped) == 1 {
+		return strings.Join(escaped, ",")
+	}
+	return "(" + strings.Join(escaped, "|") + ")"
+}
+
+func formatQueryParam(name string, values []string, _ bool) string {
+	params := make([]string, len(values))
+	for i, v := range values {
+		params[i] = "var-" + encodeURIComponent(name) + "=" + encodeURIComponent(v)
+	}
+	return strings.Join(params, "&")
+}
+
+func formatRaw(_ string, values []string, _ bool) string {
+	return strings.Join(values, ",")
+}
+
+func formatRegex(_ string, values []string, multi bool) string {
+	escaped := make([]string, len(values))
+	for i, v := range values {
+		escaped[i] = regexEscape(v)
+	}
+	if !multi || len(escaped) == 1 {
+		return strings.Join(escaped, ",")
+	}
+	return "(" + strings.Join(escaped, "|") + ")"
+}
+
+func formatSingleQuote(_ string, values []string, _ bool) string {
+	return quoteEach(values, `'`, `\'`)
+}
+
+func formatSQLString(_ string, values []string, _ bool) string {
+	return quoteEach(values, `'`, `''`)
+}
+
+func formatText(_ string, values []string, _ bool) string {
+	return strings.Join(values, " + ")
+}
+
+// quoteEach quotes every value with quote, and joins them with comma.
+func quoteEach(values []string, quote string, escapedQuote string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quote + strings.ReplaceAll(v, quote, escapedQuote) + quote
+	}
+	return strings.Join(quoted, ",")
+}
+
+// regexEscape escapes the regex meta characters the same as Grafana's kbn.regexEscape.
+func regexEscape(s string) string {
+	return escapeFunc(s, func(c rune) bool {
+		return strings.ContainsRune(`\^$*+?.()|[]{}/`, c)
+	})
+}
+
+// prometheusRegexEscape escapes the regex meta characters in a PromQL string literal,
+// the same as Grafana's prometheusSpecialRegexEscape.
+func prometheusRegexEscape(s string) string {
+	var sb strings.Builder
+	for _, c := range s {
+		switch {
+		case c == '\\':
+			sb.WriteString(`\\\\`)
+		case strings.ContainsRune(`$^*{}[]'+?.()|`, c):
+			sb.WriteString(`\\`)
+			sb.WriteRune(c)
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// luceneEscape escapes the lucene special characters the same as Grafana's luceneEscape.
+func luceneEscape(s string) string {
+	return escapeFunc(s, func(c rune) bool {
+		return strings.ContainsRune(`!*+-=<>&|()[]{}^~?:\/"`, c) || isJSWhitespace(c)
+	})
+}
+
+// escapeFunc prefixes the characters satisfying shouldEscape with a backslash.
+func escapeFunc(s string, shouldEscape func(rune) bool) string {
+	var sb strings.Builder
+	for _, c := range s {
+		if shouldEscape(c) {
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(c)
+	}
+	return sb.String()
+}
+
+// isJSWhitespace reports whether c matches \s in JavaScript regular expressions.
+func isJSWhitespace(c rune) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r', 0xa0, 0x1680, 0x2028, 0x2029, 0x202f, 0x205f, 0x3000, 0xfeff:
+		return true
+	}
+	return 0x2000 <= c && c <= 0x200a
+}
+
+// encodeURIComponent encodes s like Grafana's encodeURIComponentStrict, which also
+// escapes the characters !'()* that JavaScript's encodeURIComponent keeps.
+func encodeURIComponent(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if isIdentifierChar(c) || c == '-' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,102 @@
+package grafana
+
+import (
+	"testing"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+// The expectations follow the examples in Grafana's advanced variable format options document.
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		format   string
+		values   []string
+		multi    bool
+		expected string
+	}{
+		{"csv", []string{"test1", "test2"}, true, "test1,test2"},
+		{"csv", []string{"test1"}, false, "test1"},
+		{"distributed", []string{"test1", "test2"}, true, "test1,servers=test2"},
+		{"distributed", []string{"test1"}, false, "test1"},
+		{"doublequote", []string{"test1", "test2"}, true, `"test1","test2"`},
+		{"doublequote", []string{`te"st`}, false, `"te\"st"`},
+		{"glob", []string{"test1", "test2"}, true, "{test1,test2}"},
+		{"glob", []string{"test1"}, true, "test1"},
+		{"glob", []string{"test1"}, false, "test1"},
+		{"json", []string{"test1", "test2"}, true, `["test1","test2"]`},
+		{"json", []string{"test1"}, true, `["test1"]`},
+		{"json", []string{`a"<b>`}, false, `"a\"<b>"`},
+		{"lucene", []string{"test1", "test2"}, true, `("test1" OR "test2")`},
+		{"lucene", []string{"test1"}, true, `("test1")`},
+		{"lucene", nil, true, "__empty__"},
+		{"lucene", []string{"foo bar:baz/(1)"}, false, `foo\ bar\:baz\/\(1\)`},
+		{"percentencode", []string{"foo()bar BAZ", "test2"}, true, "%7Bfoo%28%29bar%20BAZ%2Ctest2%7D"},
+		{"percentencode", []string{"a/b?c=d&e!'*"}, false, "a%2Fb%3Fc%3Dd%26e%21%27%2A"},
+		{"pipe", []string{"test1.", "test2"}, true, "test1.|test2"},
+		{"pipe", []string{"test1."}, false, "test1."},
+		{"queryparam", []string{"test1", "test 2"}, true, "var-servers=test1&var-servers=test%202"},
+		{"raw", []string{"test.1", "test2"}, true, "test.1,test2"},
+		{"raw", []string{"a.*"}, false, "a.*"},
+		{"regex", []string{"test1.", "test2"}, true, `(test1\.|test2)`},
+		{"regex", []string{"test1."}, true, `test1\.`},
+		{"regex", []string{"a/b(c)[d]{e}^f$g*h+i?j|k\\"}, false, `a\/b\(c\)\[d\]\{e\}\^f\$g\*h\+i\?j\|k\\`},
+		{"singlequote", []string{"test1", "test2"}, true, `'test1','test2'`},
+		{"singlequote", []string{"it's"}, false, `'it\'s'`},
+		{"sqlstring", []string{"test'1", "test2"}, true, `'test''1','test2'`},
+		{"sqlstring", []string{"test1"}, false, `'test1'`},
+		{"text", []string{"test1", "test2"}, true, "test1 + test2"},
+		{"", []string{"test1", "test2"}, true, "{test1,test2}"},
+		{"unknown", []string{"test1", "test2"}, true, "{test1,test2}"},
+		{"", []string{"a.b"}, false, "a.b"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, formatValue("servers", tt.values, tt.multi, tt.format), "%s %v", tt.format, tt.values)
+	}
+}
+
+func TestInterpolateWithFormat(t *testing.T) {
+	scope := singleScope(map[string]string{"SERVICE_NAME": "news.v1"})
+
+	assert.Equal(t, `up{service=~"news\.v1"}`, interpolate(`up{service=~"${SERVICE_NAME:regex}"}`, scope, ""))
+	assert.Equal(t, `'news.v1'`, interpolate(`[[SERVICE_NAME:sqlstring]]`, scope, ""))
+	assert.Equal(t, `"news.v1"`, interpolate(`${SERVICE_NAME:json}`, scope, ""))
+	assert.Equal(t, `news.v1`, interpolate(`${SERVICE_NAME:unknown}`, scope, ""))
+}
+
+const namedDatasourceDashboard = `{
+  "__inputs": [{"name": "DS_PROM", "type": "datasource", "pluginId": "prometheus"}],
+  "panels": [
+    {"type": "graph", "title": "by name", "datasource": "MyInfluxDB",
+     "targets": [{"query": "SELECT * FROM req WHERE service =~ /^$SERVICE_NAME$/", "refId": "A"}]},
+    {"type": "graph", "title": "by input", "datasource": "${DS_PROM}",
+     "targets": [{"expr": "up{service=~\"$SERVICE_NAME\"}", "refId": "A"}]},
+    {"type": "graph", "title": "by variable", "datasource": {"uid": "$datasource"},
+     "targets": [{"expr": "up{service=~\"$SERVICE_NAME\"}", "refId": "A"}]},
+    {"type": "graph", "title": "unknown", "datasource": "other",
+     "targets": [{"target": "$SERVICE_NAME.up", "refId": "A"}]}
+  ],
+  "templating": {"list": [{"name": "datasource", "type": "datasource", "query": "prometheus"}]}
+}`
+
+func TestRenderNamedDatasources(t *testing.T) {
+	vars := RenderVars{{Name: "SERVICE_NAME", Multi: true, Values: []Val{{Value: "news"}, {Value: "payment"}}}}
+	rendered, err := RenderDashboardWithOptions([]byte(namedDatasourceDashboard), vars,
+		RenderOptions{Datasources: map[string]string{"myinfluxdb": "influxdb"}})
+	assert.Nil(t, err)
+
+	j, err := simplejson.NewJson(rendered)
+	assert.Nil(t, err)
+	target := func(i int, key string) string {
+		return j.Get("panels").GetIndex(i).Get("targets").GetIndex(0).Get(key).MustString()
+	}
+	assert.Equal(t, "SELECT * FROM req WHERE service =~ /^(news|payment)$/", target(0, "query"))
+	assert.Equal(t, `up{service=~"(news|payment)"}`, target(1, "expr"))
+	assert.Equal(t, `up{service=~"(news|payment)"}`, target(2, "expr"))
+	assert.Equal(t, "{news,payment}.up", target(3, "target"))
+
+	dashboard, err := simplejson.NewJson([]byte(namedDatasourceDashboard))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"MyInfluxDB", "other"}, unknownDatasources(dashboard, datasourceTypes(dashboard, nil)))
+}
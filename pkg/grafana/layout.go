@@ -0,0 +1,148 @@
+package grafana
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+// gridRect is the rectangle of a panel in the dashboard grid.
+type gridRect struct {
+	x, y, w, h int
+}
+
+func (a gridRect) overlaps(b gridRect) bool {
+	return a.x < b.x+b.w && b.x < a.x+a.w && a.y < b.y+b.h && b.y < a.y+a.h
+}
+
+// layoutPanels lays out the rendered panels the way Grafana does, the panels fall to the top of the grid
+// as far as they can without overlapping, keeping their columns and their order from top to bottom,
+// and the panels sticking out of the 24 columns are moved or shrunk into the grid.
+// The panels of a collapsed row move with the row, and fall to the top of the row.
+func layoutPanels(panels []map[string]interface{}) error {
+	rowYs := make(map[int]int, len(panels))
+	for i, p := range panels {
+		_, rowYs[i], _, _ = gridPos(p)
+	}
+	compactPanels(panels, 0)
+
+	for i, p := range panels {
+		nested := panelMaps(p["panels"])
+		if p["type"] != "row" || len(nested) == 0 {
+			continue
+		}
+		_, y, _, _ := gridPos(p)
+		for _, n := range nested {
+			moveDown(n, y-rowYs[i])
+		}
+		compactPanels(nested, y+1)
+		if err := validateLayout(nested); err != nil {
+			return fmt.Errorf("row %v: %w", p["title"], err)
+		}
+	}
+	return validateLayout(panels)
+}
+
+// compactPanels moves the panels up as far as they can go without overlapping the panels above them,
+// but not above the top, the panels overlapping the ones above them are moved down.
+func compactPanels(panels []map[string]interface{}, top int) {
+	type item struct {
+		panel map[string]interface{}
+		rect  gridRect
+	}
+	var items []item
+	for _, p := range panels {
+		if _, ok := p["gridPos"]; !ok {
+			continue
+		}
+		x, y, w, h := gridPos(p)
+		if w > gridColumnCount {
+			w = gridColumnCount
+		}
+		if x+w > gridColumnCount {
+			x = gridColumnCount - w
+		}
+		if x < 0 {
+			x = 0
+		}
+		items = append(items, item{panel: p, rect: gridRect{x: x, y: y, w: w, h: h}})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].rect.y != items[j].rect.y {
+			return items[i].rect.y < items[j].rect.y
+		}
+		return items[i].rect.x < items[j].rect.x
+	})
+
+	placed := make([]gridRect, 0, len(items))
+	collision := func(r gridRect) (gridRect, bool) {
+		for _, p := range placed {
+			if p.overlaps(r) {
+				return p, true
+			}
+		}
+		return gridRect{}, false
+	}
+	for _, it := range items {
+		r := it.rect
+		if r.y < top {
+			r.y = top
+		}
+		for {
+			c, ok := collision(r)
+			if !ok {
+				break
+			}
+			r.y = c.y + c.h
+		}
+		for r.y > top {
+			up := r
+			up.y--
+			if _, ok := collision(up); ok {
+				break
+			}
+			r = up
+		}
+		placed = append(placed, r)
+		movePanel(it.panel, r)
+	}
+}
+
+// movePanel updates the position and size of the panel which changed, the other fields of gridPos are kept.
+func movePanel(p map[string]interface{}, r gridRect) {
+	x, y, w, _ := gridPos(p)
+	pos := simplejson.NewFromAny(p).Get("gridPos")
+	for _, f := range []struct {
+		key      string
+		old, new int
+	}{{"x", x, r.x}, {"y", y, r.y}, {"w", w, r.w}} {
+		if f.old != f.new {
+			pos.Set(f.key, f.new)
+		}
+	}
+}
+
+// validateLayout checks that the panels fit in the grid and don't overlap.
+func validateLayout(panels []map[string]interface{}) error {
+	var rects []gridRect
+	var titles []interface{}
+	for _, p := range panels {
+		if _, ok := p["gridPos"]; !ok {
+			continue
+		}
+		x, y, w, h := gridPos(p)
+		r := gridRect{x: x, y: y, w: w, h: h}
+		if x < 0 || y < 0 || w < 0 || h < 0 || x+w > gridColumnCount {
+			return fmt.Errorf("panel %v at x=%d y=%d w=%d h=%d is out of the grid", p["title"], x, y, w, h)
+		}
+		for i, other := range rects {
+			if r.overlaps(other) {
+				return fmt.Errorf("panel %v overlaps panel %v", p["title"], titles[i])
+			}
+		}
+		rects = append(rects, r)
+		titles = append(titles, p["title"])
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package grafana
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func layoutOf(t *testing.T, panels string) []map[string]interface{} {
+	var maps []map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(panels), &maps))
+	return maps
+}
+
+func TestLayoutPanels(t *testing.T) {
+	panels := layoutOf(t, `[
+  {"title": "top", "gridPos": {"h": 2, "w": 12, "x": 0, "y": 3}},
+  {"title": "overlapping", "gridPos": {"h": 2, "w": 12, "x": 6, "y": 4}},
+  {"title": "wide", "gridPos": {"h": 2, "w": 30, "x": 4, "y": 10, "static": true}},
+  {"title": "no position"},
+  {"type": "row", "title": "row", "collapsed": true, "gridPos": {"h": 1, "w": 24, "x": 0, "y": 20}, "panels": [
+    {"title": "nested", "gridPos": {"h": 2, "w": 6, "x": 18, "y": 23}},
+    {"title": "nested below", "gridPos": {"h": 2, "w": 6, "x": 18, "y": 24}}
+  ]}
+]`)
+	assert.Nil(t, layoutPanels(panels))
+
+	var layout []renderedPanel
+	encoded, _ := json.Marshal(panels)
+	assert.Nil(t, json.Unmarshal(encoded, &layout))
+	assert.Equal(t, []string{
+		"top x=0 y=0 w=12 h=2",
+		"overlapping x=6 y=2 w=12 h=2",
+		"wide x=0 y=4 w=24 h=2",
+		"no position x=0 y=0 w=0 h=0",
+		"row x=0 y=6 w=24 h=1",
+	}, panelLayout(layout))
+	assert.Equal(t, true, panels[2]["gridPos"].(map[string]interface{})["static"])
+	_, ok := panels[3]["gridPos"]
+	assert.False(t, ok)
+
+	// the nested panels fall to the top of the collapsed row
+	var nested []renderedPanel
+	encoded, _ = json.Marshal(panels[4]["panels"])
+	assert.Nil(t, json.Unmarshal(encoded, &nested))
+	assert.Equal(t, []string{
+		"nested x=18 y=7 w=6 h=2",
+		"nested below x=18 y=9 w=6 h=2",
+	}, panelLayout(nested))
+}
+
+func TestValidateLayout(t *testing.T) {
+	assert.Nil(t, validateLayout(layoutOf(t, `[
+  {"title": "a", "gridPos": {"h": 2, "w": 12, "x": 0, "y": 0}},
+  {"title": "b", "gridPos": {"h": 2, "w": 12, "x": 12, "y": 0}},
+  {"title": "c", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 2}}
+]`)))
+
+	err := validateLayout(layoutOf(t, `[
+  {"title": "a", "gridPos": {"h": 2, "w": 12, "x": 0, "y": 0}},
+  {"title": "b", "gridPos": {"h": 2, "w": 12, "x": 11, "y": 1}}
+]`))
+	assert.EqualError(t, err, "panel b overlaps panel a")
+
+	err = validateLayout(layoutOf(t, `[{"title": "a", "gridPos": {"h": 2, "w": 12, "x": 16, "y": 0}}]`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,116 @@
+package grafana
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// defaultTemplateMarker marks the title of the template dashboard.
+const defaultTemplateMarker = "**template**"
+
+// The ways to record the template of the rendered dashboards.
+const (
+	// ProvenanceDescription appends the template to the description of the dashboard.
+	ProvenanceDescription = "description"
+	// ProvenanceLink adds a link to the template dashboard.
+	ProvenanceLink = "link"
+)
+
+// withMetadata sets the title, the tags and the provenance of the dashboard rendered from the template.
+func withMetadata(jsonBytes []byte, config UpdateConfig, tmpl Template, vars RenderVars) ([]byte, error) {
+	options := config.RenderOptions
+	if config.Title == "" && len(options.AddTags) == 0 && len(options.RemoveTags) == 0 && options.Provenance == "" {
+		return jsonBytes, nil
+	}
+
+	var dashboard map[string]interface{}
+	if err := json.Unmarshal(jsonBytes, &dashboard); err != nil {
+		return nil, err
+	}
+	title, _ := dashboard["title"].(string)
+	data := patternData(vars)
+	data["Title"] = title
+	data["TemplateUID"] = tmpl.UID
+	data["Name"] = config.Name
+
+	if config.Title != "" {
+		title, err := executePattern(config.Title, data)
+		if err != nil {
+			return nil, err
+		}
+		dashboard["title"] = title
+	}
+
+	if len(options.AddTags) > 0 || len(options.RemoveTags) > 0 {
+		tags, err := renderedTags(dashboard["tags"], options, data)
+		if err != nil {
+			return nil, err
+		}
+		dashboard["tags"] = tags
+	}
+
+	// the source of a template in Grafana is its UID already
+	source := tmpl.Source
+	if tmpl.URL == "" && tmpl.UID != "" {
+		source += " (" + tmpl.UID + ")"
+	}
+	switch options.Provenance {
+	case "":
+	case ProvenanceDescription:
+		provenance := "Generated by grafops from the template " + source + "."
+		if description, _ := dashboard["description"].(string); description != "" {
+			provenance = description + "\n\n" + provenance
+		}
+		dashboard["description"] = provenance
+	case ProvenanceLink:
+		if tmpl.URL == "" {
+			return nil, fmt.Errorf("the template %s isn't in Grafana to link, record the provenance in the %s instead",
+				tmpl.Source, ProvenanceDescription)
+		}
+		links, _ := dashboard["links"].([]interface{})
+		dashboard["links"] = append(links, map[string]interface{}{
+			"title":   "Template",
+			"type":    "link",
+			"url":     tmpl.URL,
+			"tooltip": "Generated by grafops from the template " + source,
+			"icon":    "doc",
+		})
+	default:
+		return nil, fmt.Errorf("unknown provenance option %q, it should be %s or %s",
+			options.Provenance, ProvenanceDescription, ProvenanceLink)
+	}
+	return json.Marshal(dashboard)
+}
+
+// renderedTags returns the tags without the removed tags and with the added tags, the tags are patterns.
+func renderedTags(value interface{}, options RenderOptions, data map[string]string) ([]string, error) {
+	removed := make(map[string]bool, len(options.RemoveTags))
+	for _, pattern := range options.RemoveTags {
+		tag, err := executePattern(pattern, data)
+		if err != nil {
+			return nil, err
+		}
+		removed[tag] = true
+	}
+
+	tags := []string{}
+	seen := make(map[string]bool)
+	existing, _ := value.([]interface{})
+	for _, t := range existing {
+		if tag, ok := t.(string); ok && !removed[tag] && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	for _, pattern := range options.AddTags {
+		tag, err := executePattern(pattern, data)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
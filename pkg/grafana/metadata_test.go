@@ -0,0 +1,78 @@
+package grafana
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const metadataTemplate = `{"uid": "svc", "title": "[tmpl] $SERVICE_NAME", "description": "Latency of the service.",
+  "tags": ["template", "svc"], "links": [], "panels": [
+  {"type": "text", "id": 1, "title": "About", "content": "Dashboards titled [tmpl] or **template** are templates.",
+   "gridPos": {"h": 8, "w": 24, "x": 0, "y": 0}}
+]}`
+
+func TestTemplateMarker(t *testing.T) {
+	vars := RenderVars{{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}}}}
+	rendered, err := RenderDashboardWithOptions([]byte(metadataTemplate), vars, RenderOptions{TemplateMarker: "[tmpl] "})
+	assert.Nil(t, err)
+
+	var dashboard map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rendered, &dashboard))
+	assert.Equal(t, "news", dashboard["title"])
+	// the marker is only removed from the title
+	panel := dashboard["panels"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "Dashboards titled [tmpl] or **template** are templates.", panel["content"])
+}
+
+func TestWithMetadata(t *testing.T) {
+	vars := RenderVars{{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}}}}
+	tmpl := Template{UID: "svc", Source: "./svc.json", Dashboard: []byte(metadataTemplate)}
+	config := UpdateConfig{
+		Name:  "prod",
+		Title: "{{.SERVICE_NAME}} ({{.Name}}) from {{.Title}}",
+		RenderOptions: RenderOptions{
+			TemplateMarker: "[tmpl] ",
+			AddTags:        []string{"generated-by:grafops", "template:{{.TemplateUID}}", "svc"},
+			RemoveTags:     []string{"template"},
+			Provenance:     ProvenanceDescription,
+		},
+	}
+	rendered, err := renderTemplate(config, tmpl, "", vars, 0)
+	assert.Nil(t, err)
+
+	var dashboard map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rendered.Dashboard, &dashboard))
+	assert.Equal(t, "news (prod) from news", dashboard["title"])
+	assert.Equal(t, []interface{}{"svc", "generated-by:grafops", "template:svc"}, dashboard["tags"])
+	assert.Equal(t, "Latency of the service.\n\nGenerated by grafops from the template ./svc.json (svc).",
+		dashboard["description"])
+
+	// the template in a file can't be linked
+	config.RenderOptions.Provenance = ProvenanceLink
+	_, err = renderTemplate(config, tmpl, "", vars, 0)
+	assert.NotNil(t, err)
+
+	tmpl.Source, tmpl.URL = "dashboard svc", "/d/svc"
+	rendered, err = renderTemplate(config, tmpl, "", vars, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(rendered.Dashboard, &dashboard))
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"title":   "Template",
+		"type":    "link",
+		"url":     "/d/svc",
+		"tooltip": "Generated by grafops from the template dashboard svc",
+		"icon":    "doc",
+	}}, dashboard["links"])
+
+	invalidConfigs := []UpdateConfig{
+		{Title: "{{.TEAM}}"},
+		{RenderOptions: RenderOptions{AddTags: []string{"{{.TEAM"}}},
+		{RenderOptions: RenderOptions{Provenance: "tags"}},
+	}
+	for _, invalid := range invalidConfigs {
+		_, err = renderTemplate(invalid, tmpl, "", vars, 0)
+		assert.NotNil(t, err, "%+v", invalid)
+	}
+}
@@ -0,0 +1,74 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/grafana-tools/sdk"
+)
+
+// orgHeader is the header selecting the organization of the request.
+const orgHeader = "X-Grafana-Org-Id"
+
+// Org is an organization of Grafana, it's selected by the ID or the name, and the default
+// organization of the credentials is used if neither is given.
+type Org struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// resolveID returns the ID of the org, the name is resolved in the organizations of the user.
+func (o Org) resolveID(ctx context.Context, cli *apiClient) (int, error) {
+	if o.ID != 0 && o.Name != "" {
+		return 0, errors.New("either the org ID or the org name can be given")
+	}
+	if o.Name == "" {
+		return o.ID, nil
+	}
+
+	var orgs []struct {
+		OrgID int    `json:"orgId"`
+		Name  string `json:"name"`
+	}
+	if err := cli.do(ctx, http.MethodGet, "/api/user/orgs", nil, &orgs); err != nil {
+		return 0, fmt.Errorf("fail to find the org %s: %w", o.Name, err)
+	}
+	for _, org := range orgs {
+		if org.Name == o.Name {
+			return org.OrgID, nil
+		}
+	}
+	return 0, fmt.Errorf("org %s isn't found in the orgs of the user", o.Name)
+}
+
+// withOrg makes the client send the requests to the org of the config.
+func withOrg(ctx context.Context, cli *apiClient, org Org) error {
+	if org == (Org{}) {
+		return nil
+	}
+	id, err := org.resolveID(ctx, cli)
+	if err != nil {
+		return err
+	}
+	cli.client.Transport = &headerTransport{
+		headers: map[string]string{orgHeader: strconv.Itoa(id)},
+		base:    cli.client.Transport,
+	}
+	return nil
+}
+
+// crossOrg tells if the template is read from another org than the one the dashboards are rendered to.
+func (c UpdateConfig) crossOrg() bool {
+	return c.TemplateOrg != (Org{}) && c.TemplateOrg != c.Org
+}
+
+// NewTemplateClient returns the sdk client of the org of the template dashboard in Grafana.
+func NewTemplateClient(config UpdateConfig) (*sdk.Client, error) {
+	if config.TemplateOrg != (Org{}) {
+		config.Org = config.TemplateOrg
+	}
+	return NewClient(config)
+}
@@ -0,0 +1,56 @@
+package grafana
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrg(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/api/user/orgs" {
+			assert.Empty(t, req.Header.Get(orgHeader))
+			_, _ = w.Write([]byte(`[{"orgId": 1, "name": "Main Org.", "role": "Admin"}, {"orgId": 3, "name": "team-a", "role": "Editor"}]`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"org": "` + req.Header.Get(orgHeader) + `"}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		org      Org
+		expected string
+	}{
+		{"default", Org{}, ""},
+		{"by ID", Org{ID: 2}, "2"},
+		{"by name", Org{Name: "team-a"}, "3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL, Org: test.org})
+			assert.Nil(t, err)
+			var resp struct {
+				Org string `json:"org"`
+			}
+			assert.Nil(t, cli.do(context.Background(), http.MethodGet, "/api/search", nil, &resp))
+			assert.Equal(t, test.expected, resp.Org)
+		})
+	}
+
+	for _, org := range []Org{{Name: "team-b"}, {ID: 3, Name: "team-a"}} {
+		_, err := newAPIClient(UpdateConfig{APIUrl: server.URL, Org: org})
+		assert.NotNil(t, err, "%+v", org)
+	}
+}
+
+func TestCrossOrg(t *testing.T) {
+	assert.False(t, UpdateConfig{}.crossOrg())
+	assert.False(t, UpdateConfig{Org: Org{ID: 2}}.crossOrg())
+	assert.False(t, UpdateConfig{Org: Org{ID: 2}, TemplateOrg: Org{ID: 2}}.crossOrg())
+	assert.True(t, UpdateConfig{Org: Org{ID: 2}, TemplateOrg: Org{ID: 1}}.crossOrg())
+	assert.True(t, UpdateConfig{TemplateOrg: Org{Name: "templates"}}.crossOrg())
+}
@@ -0,0 +1,399 @@
+package grafana
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+var (
+	prometheusLabelValues = regexp.MustCompile(`^label_values\((?:(.+),\s*)?([a-zA-Z_$][a-zA-Z0-9_]*)\)\s*$`)
+	prometheusLabelNames  = regexp.MustCompile(`^label_names\(\)\s*$`)
+	prometheusMetrics     = regexp.MustCompile(`^metrics\((.+)\)\s*$`)
+	prometheusQueryResult = regexp.MustCompile(`^query_result\((.+)\)\s*$`)
+	// firstNumber is the first number in the value, the numerical sorts compare it like Grafana.
+	firstNumber = regexp.MustCompile(`.*?(\d+).*`)
+)
+
+// datasource is the datasource of a query variable.
+type datasource struct {
+	ID       int    `json:"id"`
+	UID      string `json:"uid"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Database string `json:"database"`
+	JSONData struct {
+		DBName string `json:"dbName"`
+	} `json:"jsonData"`
+	IsDefault bool `json:"isDefault"`
+}
+
+// resolveQueryVars fills in the values of the query vars by running the queries of their template variables
+// through the datasource proxy of Grafana. The queries can refer to the vars before them.
+func resolveQueryVars(ctx context.Context, cli *apiClient, body []byte, vars RenderVars) (RenderVars, error) {
+	hasQuery := false
+	for _, v := range vars {
+		hasQuery = hasQuery || v.Query
+	}
+	if !hasQuery {
+		return vars, nil
+	}
+	if cli == nil || cli.baseURL == "" {
+		return nil, errors.New("the values of the query vars can only be found through the Grafana API")
+	}
+
+	dashboard, err := simplejson.NewJson(body)
+	if err != nil {
+		return nil, err
+	}
+	templates := templateVariables(dashboard)
+
+	resolved := make(RenderVars, len(vars))
+	copy(resolved, vars)
+	for i, v := range resolved {
+		if !v.Query {
+			continue
+		}
+		tmpl, ok := templates[v.Name]
+		if !ok || tmpl.Type != "query" {
+			return nil, fmt.Errorf("the var %s isn't a query variable of the template", v.Name)
+		}
+
+		// the other vars in the query are rendered like the queries of the panels
+		scope := newRenderer(dashboard, resolved, RenderOptions{}).globalScope()
+		values, err := runVariableQuery(ctx, cli, tmpl, scope)
+		if err != nil {
+			return nil, fmt.Errorf("fail to find the values of the var %s: %w", v.Name, err)
+		}
+		values, err = filterValues(values, tmpl.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex of the var %s: %w", v.Name, err)
+		}
+		sortValues(values, tmpl.Sort)
+
+		v.Values = make([]Val, len(values))
+		for j, value := range values {
+			v.Values[j] = Val{Value: value}
+		}
+		resolved[i] = v
+	}
+	return resolved, nil
+}
+
+// runVariableQuery runs the query of the template variable through the datasource proxy.
+func runVariableQuery(ctx context.Context, cli *apiClient, tmpl templateVariable,
+	scope renderScope) ([]string, error) {
+	ds, err := findDatasource(ctx, cli, tmpl.Datasource, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	query, _ := tmpl.Query.(string)
+	if q, ok := tmpl.Query.(map[string]interface{}); ok {
+		query, _ = q["query"].(string)
+	}
+	query = strings.TrimSpace(interpolate(query, scope.vars, ds.Type))
+	if query == "" {
+		return nil, errors.New("the query is empty")
+	}
+
+	proxy := fmt.Sprintf("/api/datasources/proxy/%d", ds.ID)
+	switch ds.Type {
+	case "prometheus":
+		return prometheusQuery(ctx, cli, proxy, query)
+	case "influxdb":
+		return influxQuery(ctx, cli, proxy, ds, query)
+	default:
+		return nil, fmt.Errorf("the datasource type %q isn't supported", ds.Type)
+	}
+}
+
+// findDatasourceTypes returns the given types of the datasources with the types of the datasources the dashboard
+// refers to by the name or the UID found in Grafana, they are only looked up if the client is given and some
+// types aren't known.
+func findDatasourceTypes(ctx context.Context, cli *apiClient, dashboard *simplejson.Json,
+	given map[string]string) (map[string]string, error) {
+	if cli == nil || len(unknownDatasources(dashboard, datasourceTypes(dashboard, given))) == 0 {
+		return given, nil
+	}
+	var all []datasource
+	if err := cli.do(ctx, http.MethodGet, "/api/datasources", nil, &all); err != nil {
+		return nil, fmt.Errorf("fail to find the datasource types: %w", err)
+	}
+	types := make(map[string]string, len(all)*2+len(given))
+	for _, ds := range all {
+		types[ds.Name] = ds.Type
+		types[ds.UID] = ds.Type
+	}
+	for ref, t := range given {
+		types[ref] = t
+	}
+	return types, nil
+}
+
+// findDatasource finds the datasource by the UID or the name the template variable refers to,
+// or the default datasource if it refers to none.
+func findDatasource(ctx context.Context, cli *apiClient, ref interface{}, scope renderScope) (datasource, error) {
+	var ds datasource
+	switch r := ref.(type) {
+	case map[string]interface{}:
+		uid, _ := r["uid"].(string)
+		uid = interpolate(uid, scope.vars, "")
+		err := cli.do(ctx, http.MethodGet, "/api/datasources/uid/"+url.PathEscape(uid), nil, &ds)
+		return ds, err
+	case string:
+		name := interpolate(r, scope.vars, "")
+		if name != "" && name != "default" {
+			err := cli.do(ctx, http.MethodGet, "/api/datasources/name/"+url.PathEscape(name), nil, &ds)
+			return ds, err
+		}
+	}
+
+	var all []datasource
+	if err := cli.do(ctx, http.MethodGet, "/api/datasources", nil, &all); err != nil {
+		return ds, err
+	}
+	for _, d := range all {
+		if d.IsDefault {
+			return d, nil
+		}
+	}
+	return ds, errors.New("there is no default datasource")
+}
+
+// prometheusQuery runs the Prometheus variable query, e.g. `label_values(up{job="api"}, instance)`.
+func prometheusQuery(ctx context.Context, cli *apiClient, proxy string, query string) ([]string, error) {
+	var resp struct {
+		Data interface{} `json:"data"`
+	}
+
+	if m := prometheusLabelValues.FindStringSubmatch(query); m != nil {
+		metric, label := m[1], m[2]
+		if metric == "" {
+			err := cli.do(ctx, http.MethodGet, proxy+"/api/v1/label/"+url.PathEscape(label)+"/values", nil, &resp)
+			return stringValues(resp.Data), err
+		}
+		params := url.Values{"match[]": {metric}}
+		if err := cli.do(ctx, http.MethodGet, proxy+"/api/v1/series?"+params.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		var values []string
+		for _, series := range simplejson.NewFromAny(resp.Data).MustArray() {
+			if value, err := simplejson.NewFromAny(series).Get(label).String(); err == nil {
+				values = append(values, value)
+			}
+		}
+		return values, nil
+	}
+
+	if prometheusLabelNames.MatchString(query) {
+		err := cli.do(ctx, http.MethodGet, proxy+"/api/v1/labels", nil, &resp)
+		return stringValues(resp.Data), err
+	}
+
+	if m := prometheusMetrics.FindStringSubmatch(query); m != nil {
+		pattern, err := regexp.Compile(m[1])
+		if err != nil {
+			return nil, err
+		}
+		if err := cli.do(ctx, http.MethodGet, proxy+"/api/v1/label/__name__/values", nil, &resp); err != nil {
+			return nil, err
+		}
+		var values []string
+		for _, name := range stringValues(resp.Data) {
+			if pattern.MatchString(name) {
+				values = append(values, name)
+			}
+		}
+		return values, nil
+	}
+
+	if m := prometheusQueryResult.FindStringSubmatch(query); m != nil {
+		params := url.Values{"query": {m[1]}}
+		if err := cli.do(ctx, http.MethodGet, proxy+"/api/v1/query?"+params.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		var values []string
+		for _, result := range simplejson.NewFromAny(resp.Data).Get("result").MustArray() {
+			values = append(values, queryResultText(simplejson.NewFromAny(result)))
+		}
+		return values, nil
+	}
+
+	return nil, fmt.Errorf("the Prometheus query %q isn't supported", query)
+}
+
+// queryResultText returns the text of the query result like Grafana, e.g. `up{job="api"} 1 1650000000000`.
+func queryResultText(result *simplejson.Json) string {
+	metric := result.Get("metric").MustMap()
+	name, _ := metric["__name__"].(string)
+	var labels []string
+	for k, v := range metric {
+		if k != "__name__" {
+			labels = append(labels, fmt.Sprintf("%s=%q", k, v))
+		}
+	}
+	sort.Strings(labels)
+
+	value := result.Get("value")
+	timestamp, _ := value.GetIndex(0).Float64()
+	return fmt.Sprintf("%s{%s} %s %d", name, strings.Join(labels, ","), value.GetIndex(1).MustString(),
+		int64(timestamp*1000))
+}
+
+// influxQuery runs the InfluxQL variable query, e.g. `SHOW TAG VALUES WITH KEY = "service"`.
+func influxQuery(ctx context.Context, cli *apiClient, proxy string, ds datasource, query string) ([]string, error) {
+	db := ds.Database
+	if db == "" {
+		db = ds.JSONData.DBName
+	}
+	params := url.Values{"db": {db}, "q": {query}, "epoch": {"ms"}}
+	var resp struct {
+		Results []struct {
+			Error  string `json:"error"`
+			Series []struct {
+				Columns []string        `json:"columns"`
+				Values  [][]interface{} `json:"values"`
+			} `json:"series"`
+		} `json:"results"`
+	}
+	if err := cli.do(ctx, http.MethodGet, proxy+"/query?"+params.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for _, result := range resp.Results {
+		if result.Error != "" {
+			return nil, errors.New(result.Error)
+		}
+		for _, series := range result.Series {
+			// the tag values are in the `value` column, the other results are in the first column
+			col := 0
+			for i, c := range series.Columns {
+				if c == "value" {
+					col = i
+				}
+			}
+			for _, row := range series.Values {
+				if col < len(row) && row[col] != nil {
+					values = append(values, fmt.Sprint(row[col]))
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func stringValues(data interface{}) []string {
+	var values []string
+	for _, v := range simplejson.NewFromAny(data).MustArray() {
+		if s, ok := v.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// filterValues keeps the distinct values matching the regex of the variable, e.g. `/api-(.*)/`,
+// the value is the first captured group if there is any, or the group named `value`.
+func filterValues(values []string, regex string) ([]string, error) {
+	var pattern *regexp.Regexp
+	if regex != "" {
+		var err error
+		if pattern, err = compileJSRegex(regex); err != nil {
+			return nil, err
+		}
+	}
+
+	filtered := make([]string, 0, len(values))
+	seen := make(map[string]bool, len(values))
+	for _, value := range values {
+		if pattern != nil {
+			m := pattern.FindStringSubmatch(value)
+			if m == nil {
+				continue
+			}
+			if i := pattern.SubexpIndex("value"); i > 0 && m[i] != "" {
+				value = m[i]
+			} else if len(m) > 1 && m[1] != "" {
+				value = m[1]
+			}
+		}
+		if !seen[value] {
+			seen[value] = true
+			filtered = append(filtered, value)
+		}
+	}
+	return filtered, nil
+}
+
+// compileJSRegex compiles the JavaScript regex like `/pattern/i`, the pattern without the slashes is compiled as is.
+func compileJSRegex(regex string) (*regexp.Regexp, error) {
+	if len(regex) < 2 || regex[0] != '/' {
+		return regexp.Compile(regex)
+	}
+	end := strings.LastIndex(regex, "/")
+	if end == 0 {
+		return regexp.Compile(regex)
+	}
+	pattern, flags := regex[1:end], regex[end+1:]
+	var goFlags string
+	for _, f := range flags {
+		switch f {
+		case 'i', 'm', 's':
+			goFlags += string(f)
+		case 'g', 'u', 'y':
+		default:
+			return nil, fmt.Errorf("unknown regex flag %q", f)
+		}
+	}
+	if goFlags != "" {
+		pattern = "(?" + goFlags + ")" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// sortValues sorts the values by the sort option of the variable: 1 and 2 alphabetically, 3 and 4 numerically,
+// 5 and 6 alphabetically case-insensitive, odd ones ascending and even ones descending, 0 keeps the order.
+func sortValues(values []string, order int) {
+	if order <= 0 || order > 6 {
+		return
+	}
+	var less func(a, b string) bool
+	switch (order - 1) / 2 {
+	case 0:
+		less = func(a, b string) bool { return a < b }
+	case 1:
+		less = func(a, b string) bool { return valueNumber(a) < valueNumber(b) }
+	case 2:
+		less = func(a, b string) bool { return strings.ToLower(a) < strings.ToLower(b) }
+	}
+	desc := order%2 == 0
+	sort.SliceStable(values, func(i, j int) bool {
+		if desc {
+			return less(values[j], values[i])
+		}
+		return less(values[i], values[j])
+	})
+}
+
+// valueNumber returns the first number in the value, or -1 if there is none.
+func valueNumber(value string) int {
+	m := firstNumber.FindStringSubmatch(value)
+	if m == nil {
+		return -1
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return -1
+	}
+	return n
+}
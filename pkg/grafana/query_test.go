@@ -0,0 +1,159 @@
+package grafana
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+const queryTemplate = `{"uid": "svc", "title": "services", "templating": {"list": [
+  {"name": "JOB", "type": "query", "datasource": {"type": "prometheus", "uid": "prom"},
+   "query": {"query": "label_values(job)", "refId": "A"}, "regex": "/^api-(.*)$/", "sort": 1},
+  {"name": "INSTANCE", "type": "query", "datasource": "Prometheus",
+   "query": "label_values(up{job=\"api-$JOB\"}, instance)", "sort": 4},
+  {"name": "SERVICE_NAME", "type": "query", "datasource": null,
+   "query": "SHOW TAG VALUES WITH KEY = \"service\"", "regex": "/news|payment/i", "sort": 6},
+  {"name": "ENV", "type": "custom", "query": "prod,staging"}
+]}, "panels": []}`
+
+// fakeDatasourceAPI is a stand-in of the Grafana datasource proxy of Prometheus and InfluxDB.
+func fakeDatasourceAPI(t *testing.T) *httptest.Server {
+	prom := `{"id": 1, "uid": "prom", "name": "Prometheus", "type": "prometheus"}`
+	influx := `{"id": 2, "uid": "influx", "name": "InfluxDB", "type": "influxdb", "database": "metrics", "isDefault": true}`
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var resp string
+		switch req.URL.Path {
+		case "/api/datasources/uid/prom", "/api/datasources/name/Prometheus":
+			resp = prom
+		case "/api/datasources":
+			resp = "[" + prom + "," + influx + "]"
+		case "/api/datasources/proxy/1/api/v1/label/job/values":
+			resp = `{"status": "success", "data": ["api-payment", "db", "api-news", "api-news"]}`
+		case "/api/datasources/proxy/1/api/v1/series":
+			assert.Equal(t, `up{job="api-news"}`, req.URL.Query().Get("match[]"))
+			resp = `{"status": "success", "data": [
+  {"__name__": "up", "job": "api-news", "instance": "node-2:80"},
+  {"__name__": "up", "job": "api-news", "instance": "node-10:80"},
+  {"__name__": "up", "job": "api-news", "instance": "node-1:80"}]}`
+		case "/api/datasources/proxy/2/query":
+			assert.Equal(t, "metrics", req.URL.Query().Get("db"))
+			assert.Equal(t, `SHOW TAG VALUES WITH KEY = "service"`, req.URL.Query().Get("q"))
+			resp = `{"results": [{"series": [{"name": "requests", "columns": ["key", "value"],
+  "values": [["service", "news"], ["service", "Payment"], ["service", "user"]]}]}]}`
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(resp))
+	}))
+}
+
+func TestResolveQueryVars(t *testing.T) {
+	server := fakeDatasourceAPI(t)
+	defer server.Close()
+	cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL})
+	assert.Nil(t, err)
+
+	vars := RenderVars{
+		{Name: "JOB", Query: true},
+		{Name: "INSTANCE", Query: true},
+		{Name: "SERVICE_NAME", Query: true, Multi: true},
+		{Name: "ENV", Values: []Val{{Value: "prod"}}},
+	}
+	resolved, err := resolveQueryVars(context.Background(), cli, []byte(queryTemplate), vars)
+	assert.Nil(t, err)
+	assert.Equal(t, RenderVars{
+		// the regex picks the captured group, and the values are distinct and sorted alphabetically
+		{Name: "JOB", Query: true, Values: []Val{{Value: "news"}, {Value: "payment"}}},
+		// the query refers to the first JOB, and the values are sorted numerically in descending order
+		{Name: "INSTANCE", Query: true, Values: []Val{{Value: "node-10:80"}, {Value: "node-2:80"}, {Value: "node-1:80"}}},
+		// case-insensitive alphabetically in descending order
+		{Name: "SERVICE_NAME", Query: true, Multi: true, Values: []Val{{Value: "Payment"}, {Value: "news"}}},
+		{Name: "ENV", Values: []Val{{Value: "prod"}}},
+	}, resolved)
+	// the vars aren't changed
+	assert.Nil(t, vars[0].Values)
+
+	_, err = resolveQueryVars(context.Background(), cli, []byte(queryTemplate), RenderVars{{Name: "ENV", Query: true}})
+	assert.NotNil(t, err)
+	_, err = resolveQueryVars(context.Background(), nil, []byte(queryTemplate), RenderVars{{Name: "JOB", Query: true}})
+	assert.NotNil(t, err)
+}
+
+func TestRenderTemplatesWithQueryVars(t *testing.T) {
+	server := fakeDatasourceAPI(t)
+	defer server.Close()
+	dir := writeTemplates(t, map[string]string{"svc.json": queryTemplate})
+	defer os.RemoveAll(dir)
+
+	config := UpdateConfig{APIUrl: server.URL, FanOut: FanOutConfig{Var: "JOB", Title: "{{.JOB}}"}}
+	rendered, err := RenderTemplates(config, NewFileTemplateSource(dir), RenderVars{{Name: "JOB", Query: true}})
+	assert.Nil(t, err)
+	assert.Len(t, rendered, 2)
+	assert.Equal(t, "svc-news", rendered[0].Name)
+	assert.Equal(t, "svc-payment", rendered[1].Name)
+}
+
+func TestFindDatasourceTypes(t *testing.T) {
+	server := fakeDatasourceAPI(t)
+	defer server.Close()
+	cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL})
+	assert.Nil(t, err)
+
+	dashboard, err := simplejson.NewJson([]byte(`{"panels": [{"datasource": "InfluxDB"}, {"datasource": {"uid": "prom"}}]}`))
+	assert.Nil(t, err)
+	types, err := findDatasourceTypes(context.Background(), cli, dashboard, map[string]string{"InfluxDB": "flux"})
+	assert.Nil(t, err)
+	// the given types win
+	assert.Equal(t, "flux", types["InfluxDB"])
+	assert.Equal(t, "prometheus", types["prom"])
+	assert.Equal(t, "prometheus", types["Prometheus"])
+
+	// Grafana isn't asked if the types are known
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	downCli, err := newAPIClient(UpdateConfig{APIUrl: down.URL})
+	assert.Nil(t, err)
+	known := map[string]string{"InfluxDB": "influxdb", "prom": "prometheus"}
+	types, err = findDatasourceTypes(context.Background(), downCli, dashboard, known)
+	assert.Nil(t, err)
+	assert.Equal(t, known, types)
+}
+
+func TestSortValues(t *testing.T) {
+	tests := []struct {
+		order    int
+		expected []string
+	}{
+		{0, []string{"b10", "a2", "C1", "x"}},
+		{1, []string{"C1", "a2", "b10", "x"}},
+		{2, []string{"x", "b10", "a2", "C1"}},
+		{3, []string{"x", "C1", "a2", "b10"}},
+		{4, []string{"b10", "a2", "C1", "x"}},
+		{5, []string{"a2", "b10", "C1", "x"}},
+		{6, []string{"x", "C1", "b10", "a2"}},
+	}
+	for _, test := range tests {
+		values := []string{"b10", "a2", "C1", "x"}
+		sortValues(values, test.order)
+		assert.Equal(t, test.expected, values, "sort %d", test.order)
+	}
+}
+
+func TestFilterValues(t *testing.T) {
+	values, err := filterValues([]string{"api-news", "db", "API-payment", "api-news"}, "/api-(?P<value>.*)/i")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"news", "payment"}, values)
+
+	values, err = filterValues([]string{"news", "news", "payment"}, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"news", "payment"}, values)
+
+	_, err = filterValues([]string{"news"}, "/news/x")
+	assert.NotNil(t, err)
+}
@@ -4,8 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"math"
-	"net/http"
+	"fmt"
+	"hash/fnv"
+	"strconv"
 	"strings"
 
 	"github.com/grafana-tools/sdk"
@@ -13,31 +14,131 @@ import (
 )
 
 type UpdateConfig struct {
-	APIUrl       string `json:"apiUrl"`
-	DashboardUID string `json:"dashboardUID"`
-	BasicAuth    string `json:"basicAuth"`
+	APIUrl        string        `json:"apiUrl"`
+	DashboardUID  string        `json:"dashboardUID"`
+	BasicAuth     string        `json:"basicAuth"`
+	RenderOptions RenderOptions `json:"renderOptions"`
+	// Name tells the rendered dashboard from the others rendered from the same template, the UID of the
+	// rendered dashboard is derived from the template UID and the name unless RenderedUID is given.
+	Name        string `json:"name"`
+	RenderedUID string `json:"renderedUID"`
+	// Title overrides the title of the rendered dashboard, it's a pattern in the Go template syntax, the variables
+	// are the vars, and Title, TemplateUID and Name of the rendered dashboard, e.g. `{{.Title}} ({{.Name}})`.
+	Title string `json:"title"`
+	// FolderUID or FolderTitle is the folder of the rendered dashboard, it defaults to the folder of the template.
+	// FolderTitle is the path of the titles like `Teams/News` for the nested folders.
+	FolderUID   string `json:"folderUID"`
+	FolderTitle string `json:"folderTitle"`
+	// CreateFolder creates the folder, and the parent folders in the path, if it doesn't exist.
+	CreateFolder bool `json:"createFolder"`
+	// FolderPermissions replace the permissions of the folder if they are given.
+	FolderPermissions []FolderPermission `json:"folderPermissions"`
+	// FanOut renders a dashboard for each value of a var.
+	FanOut FanOutConfig `json:"fanOut"`
+	// FailOnManualEdit fails the rendering instead of overwriting the rendered dashboard if it was edited by hand.
+	FailOnManualEdit bool `json:"failOnManualEdit"`
+	// AlertRules are the unified alert rules rendered for the rendered dashboard.
+	AlertRules AlertRulesConfig `json:"alertRules"`
+	// Auth is the credentials of the Grafana API, it takes precedence over BasicAuth, which is either the
+	// basic auth `user:password` or an API key.
+	Auth Auth `json:"auth"`
+	// Org is the organization the dashboards are rendered to, TemplateOrg is the one of the template dashboard,
+	// it defaults to Org.
+	Org         Org `json:"org"`
+	TemplateOrg Org `json:"templateOrg"`
+	// HTTP is how to connect to Grafana, e.g. the CAs, the client certificate and the proxy.
+	HTTP HTTPConfig `json:"http"`
 }
 
 type Var struct {
 	Name   string `json:"name"`
 	Values []Val  `json:"values"`
+	// Multi renders the var as the set of all its values outside the repeated panels,
+	// instead of picking the first value.
+	Multi bool `json:"multi"`
+	// AllValue is the custom value of the "All" option, it overrides the allValue of the template variable.
+	AllValue string `json:"allValue"`
+	// Query takes the values from the query variable of the same name in the template, the query runs
+	// through the datasource proxy of Grafana, and the values are filtered and sorted like the variable does.
+	Query bool `json:"query"`
+	// Filter picks the values of the var repeated in the repeat of another var, it's a pattern in the Go template
+	// syntax of the outer vars, the context of the value and the value itself by the var name, the value is kept
+	// if it's rendered as `true`, e.g. `{{eq .SERVICE_REGION .REGION}}`.
+	Filter string `json:"filter"`
 }
 
+// Val is a value of the var, the value `$__all` stands for all the values of the var like the "All" option in Grafana.
 type Val struct {
-	Value   string            `json:"value"`
+	Value string `json:"value"`
+	// Values renders the val as a set of values, e.g. a repeated row querying both news and payment.
+	Values  []string          `json:"values"`
 	Context map[string]string `json:"context"`
+	// Vars override the vars in the rows and panels repeated for the val, e.g. the services of a region,
+	// which are repeated in the row of the region.
+	Vars RenderVars `json:"vars"`
+}
+
+// RenderOptions customizes how the Grafana dashboard is rendered.
+type RenderOptions struct {
+	// AlertNameSuffix is appended to the alert names of the repeated panels unless the names refer to the
+	// repeat variables, it's rendered with the variables of the panel, e.g. ` - $SERVICE_NAME`.
+	// It defaults to the values of the repeat variables in parentheses.
+	AlertNameSuffix string `json:"alertNameSuffix"`
+	// Templating is what to do with the template variables which are rendered statically, they can be
+	// kept (the default), removed, hidden or pinned to the rendered values, the other variables are kept.
+	Templating string `json:"templating"`
+	// TemplateMarker marks the title of the template dashboard, it's removed from the title of the rendered
+	// dashboard, it defaults to `**template**`.
+	TemplateMarker string `json:"templateMarker"`
+	// AddTags and RemoveTags are the tags added to or removed from the dashboards rendered from the templates,
+	// they are patterns like the title, e.g. `generated-by:grafops` or `template:{{.TemplateUID}}`.
+	AddTags    []string `json:"addTags"`
+	RemoveTags []string `json:"removeTags"`
+	// Datasources are the plugin types of the datasources the panels refer to by the name or the UID, e.g.
+	// `myinfluxdb: influxdb`, so the variables in the queries are formatted for the datasources. The types of the
+	// inputs and the datasource variables of the template are known, and the others are found in Grafana if possible.
+	Datasources map[string]string `json:"datasources"`
+	// Provenance records the template of the dashboards rendered from the templates in the `description` or in the
+	// `link` to the template dashboard.
+	Provenance string `json:"provenance"`
 }
 
 // RenderVars is the variables used to render the Grafana dashboard
 type RenderVars []Var
 
 func (vars RenderVars) GetValues(name string) ([]Val, error) {
+	if v, ok := vars.getVar(name); ok {
+		return v.Values, nil
+	}
+	return nil, errors.New("var not found")
+}
+
+func (vars RenderVars) getVar(name string) (Var, bool) {
 	for _, v := range vars {
 		if v.Name == name {
-			return v.Values, nil
+			return v, true
 		}
 	}
-	return nil, errors.New("var not found")
+	return Var{}, false
+}
+
+// allValues returns all the distinct values of the var except the "All" option.
+func (v Var) allValues() []string {
+	var values []string
+	seen := make(map[string]bool)
+	for _, val := range v.Values {
+		vals := val.Values
+		if len(vals) == 0 && val.Value != allValue {
+			vals = []string{val.Value}
+		}
+		for _, value := range vals {
+			if !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+	}
+	return values
 }
 
 // GetGlobalContext returns the global context made by the name-value pairs,
@@ -52,171 +153,709 @@ func (vars RenderVars) GetGlobalContext() map[string]string {
 	return ctx
 }
 
-func mergeContext(ctx map[string]string, overrides map[string]string) map[string]string {
-	mergedCtx := make(map[string]string)
-	for k, v := range ctx {
-		mergedCtx[k] = v
+// RenderDashboardWithTemplate renders the grafana dashboard with predefined variables statically.
+// It's similar to the normal grafana dashboard rendering but it will support alerts with template variables.
+func RenderDashboardWithTemplate(config UpdateConfig, vars RenderVars) error {
+	grafcli, apiCli, err := newClients(config)
+	if err != nil {
+		return err
 	}
-
-	for k, v := range overrides {
-		mergedCtx[k] = v
+	templateCli := grafcli
+	if config.crossOrg() {
+		if templateCli, err = NewTemplateClient(config); err != nil {
+			return err
+		}
 	}
-	return mergedCtx
+	source := NewAPITemplateSource(templateCli, config.DashboardUID)
+	return renderDashboardsFromSource(context.Background(), grafcli, apiCli, config, source, vars)
 }
 
-// RenderDashboardWithTemplate renders the grafana dashboard with predefined variables statically.
-// It's similar to the normal grafana dashboard rendering but it will support alerts with template variables.
-func RenderDashboardWithTemplate(config UpdateConfig, vars RenderVars) error {
-	grafcli, err := sdk.NewClient(config.APIUrl, config.BasicAuth, &http.Client{})
-	rawJsonBytes, prop, err := grafcli.GetRawDashboardByUID(context.Background(), config.DashboardUID)
+// RenderDashboardsFromSource renders the dashboards of the templates from the source, and saves them in Grafana.
+func RenderDashboardsFromSource(config UpdateConfig, source TemplateSource, vars RenderVars) error {
+	grafcli, apiCli, err := newClients(config)
 	if err != nil {
 		return err
 	}
+	return renderDashboardsFromSource(context.Background(), grafcli, apiCli, config, source, vars)
+}
 
-	rendered, err := RenderDashboard(rawJsonBytes, vars)
+func renderDashboardsFromSource(ctx context.Context, grafcli *sdk.Client, apiCli *apiClient, config UpdateConfig,
+	source TemplateSource, vars RenderVars) error {
+	templates, err := loadTemplates(ctx, config, source)
 	if err != nil {
 		return err
 	}
+	for _, tmpl := range templates {
+		targets, err := templateTargets(ctx, apiCli, config, tmpl, vars)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			err := saveRendered(ctx, grafcli, apiCli, templateConfig(target.config, tmpl), tmpl, target.vars)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
 
-	// remove id and uid of the template dashboard JSON to create a new dashboard.
-	rendered = removeIDs(rendered)
-	_, err = grafcli.SetRawDashboardWithParam(context.Background(), sdk.RawBoardRequest{
-		Dashboard: rendered,
+// saveRendered renders the template and saves the rendered dashboard, and then its alert rules.
+func saveRendered(ctx context.Context, grafcli *sdk.Client, apiCli *apiClient, config UpdateConfig, tmpl Template,
+	vars RenderVars) error {
+	// the rendered dashboard has its own UID, and it replaces the version saved by the last rendering
+	uid := config.RenderedDashboardUID()
+	saved, err := getDashboard(ctx, apiCli, uid)
+	if err != nil {
+		return err
+	}
+	version := 0
+	if saved != nil {
+		if config.FailOnManualEdit && saved.editedByHand() {
+			return fmt.Errorf("dashboard %s: %w", uid, ErrEditedByHand)
+		}
+		version = saved.Meta.Version
+	}
+	rendered, err := renderTemplate(config, tmpl, "", vars, version)
+	if err != nil {
+		return err
+	}
+	folderID := tmpl.FolderID
+	if config.crossOrg() {
+		// the folder of the template is in another org
+		folderID = 0
+	}
+	if config.FolderUID != "" || config.FolderTitle != "" {
+		if folderID, err = targetFolderID(ctx, apiCli, config); err != nil {
+			return err
+		}
+	}
+	if saved == nil {
+		// the dashboards rendered before the UIDs were derived have random UIDs, the one rendered from the
+		// template with the same title in the folder is taken over instead of failing on the title
+		rendered.Dashboard, err = adoptRendered(ctx, apiCli, config, tmpl.Dashboard, rendered.Dashboard, folderID)
+		if err != nil {
+			return err
+		}
+	}
+	status, err := grafcli.SetRawDashboardWithParam(ctx, sdk.RawBoardRequest{
+		Dashboard: rendered.Dashboard,
 		Parameters: sdk.SetDashboardParams{
-			Overwrite: true,
-			FolderID:  prop.FolderID,
+			FolderID: folderID,
 		},
 	})
+	if err != nil {
+		return fmt.Errorf("fail to save the dashboard %s: %w", uid, err)
+	}
+
+	if len(config.AlertRules.Rules) == 0 {
+		return nil
+	}
+	renderedUID := uid
+	if status.UID != nil {
+		renderedUID = *status.UID
+	}
+	group, err := renderAlertRules(ctx, apiCli, tmpl.Dashboard, vars, config.RenderOptions,
+		config.AlertRules, renderedUID)
 	if err != nil {
 		return err
 	}
-	return nil
+	if config.AlertRules.File != "" {
+		return writeAlertRuleGroup(group, config.AlertRules.File)
+	}
+	return pushAlertRuleGroup(ctx, apiCli, group)
 }
 
-// RenderDashboard will render the Grafana dashboard with variables.
-func RenderDashboard(body []byte, vars RenderVars) ([]byte, error) {
-	var err error
-	if body, err = renderPanels(body, vars); err != nil {
+// adoptRendered returns the rendered dashboard JSON replacing the dashboard with the same title in the folder,
+// which was rendered from the template before the UIDs were derived. It's unchanged if there is no such dashboard,
+// so a dashboard grafops didn't render from the template still fails the saving with the title collision.
+func adoptRendered(ctx context.Context, apiCli *apiClient, config UpdateConfig, template, rendered []byte,
+	folderID int) ([]byte, error) {
+	var dashboard struct {
+		Title string `json:"title"`
+	}
+	if err := json.Unmarshal(rendered, &dashboard); err != nil {
 		return nil, err
 	}
-
-	// replace the remaining variables
-	rawJson := string(body)
-	for k, v := range vars.GetGlobalContext() {
-		rawJson = replaceVar(rawJson, k, v)
+	existing, err := dashboardByTitle(ctx, apiCli, dashboard.Title, folderID)
+	if err != nil {
+		return nil, fmt.Errorf("fail to find the dashboard %q: %w", dashboard.Title, err)
+	}
+	if existing == nil || existing.Dashboard["uid"] == config.DashboardUID || !existing.renderedFrom(template) {
+		return rendered, nil
+	}
+	if config.FailOnManualEdit && existing.editedByHand() {
+		return nil, fmt.Errorf("dashboard %v: %w", existing.Dashboard["uid"], ErrEditedByHand)
 	}
-	rawJson = strings.ReplaceAll(rawJson, "**template**", "")
-	return []byte(rawJson), nil
+	return adoptDashboard(rendered, existing)
 }
 
-// removeIDs removes the IDs of dashboard JSON.
-func removeIDs(jsonBytes []byte) []byte {
-	var jsonObject map[string]interface{}
-	_ = json.Unmarshal(jsonBytes, &jsonObject)
-	delete(jsonObject, "id")
-	delete(jsonObject, "uid")
+// RenderDashboardDryRun renders the template dashboard in Grafana like RenderDashboardWithTemplate,
+// but returns the rendered dashboards instead of saving them.
+func RenderDashboardDryRun(config UpdateConfig, vars RenderVars) ([]RenderedDashboard, error) {
+	grafcli, err := NewTemplateClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return RenderTemplates(config, NewAPITemplateSource(grafcli, config.DashboardUID), vars)
+}
 
-	newBytes, _ := json.Marshal(jsonObject)
-	return newBytes
+// RenderDashboard will render the Grafana dashboard with variables.
+func RenderDashboard(body []byte, vars RenderVars) ([]byte, error) {
+	return RenderDashboardWithOptions(body, vars, RenderOptions{})
 }
 
-// renderPanels will populate the repeated panels.
-func renderPanels(body []byte, vars RenderVars) ([]byte, error) {
-	jsonBody, err := simplejson.NewJson(body)
+// RenderDashboardWithOptions will render the Grafana dashboard with variables and the render options.
+func RenderDashboardWithOptions(body []byte, vars RenderVars, options RenderOptions) ([]byte, error) {
+	dashboard, err := simplejson.NewJson(body)
 	if err != nil {
 		return nil, err
 	}
+	return newRenderer(dashboard, vars, options).render(dashboard)
+}
 
-	panels, err := jsonBody.Get("panels").Array()
-	if err != nil {
+// render renders the dashboard, the rendered copies of the panels are kept by the renderer.
+func (r *renderer) render(dashboard *simplejson.Json) ([]byte, error) {
+	if err := r.renderPanels(dashboard); err != nil {
 		return nil, err
 	}
 
-	// add end panel for ending
-	panels = append(panels, map[string]interface{}{"end": true})
+	// replace the remaining variables, the panels are already rendered with their own variables
+	panels := dashboard.Get("panels").Interface()
+	dashboard.Del("panels")
+	global := r.globalScope()
+	rendered := renderStrings(dashboard.Interface(), r.datasources, func(s string, datasource string) string {
+		return interpolate(s, global.vars, datasource)
+	}).(map[string]interface{})
+	rendered["panels"] = panels
+
+	// only the title is marked, the panels could mention the marker
+	marker := r.options.TemplateMarker
+	if marker == "" {
+		marker = defaultTemplateMarker
+	}
+	if title, ok := rendered["title"].(string); ok {
+		rendered["title"] = strings.ReplaceAll(title, marker, "")
+	}
+	if err := r.processTemplating(rendered); err != nil {
+		return nil, err
+	}
+	return json.Marshal(rendered)
+}
+
+// renderPanels will populate the repeated rows and panels.
+func (r *renderer) renderPanels(dashboard *simplejson.Json) error {
+	panels, err := dashboard.Get("panels").Array()
+	if err != nil {
+		return err
+	}
 
 	var (
-		newPanels, repeatedPanels []map[string]interface{}
-		yOffset                   = 0
+		newPanels []map[string]interface{}
+		global    = r.globalScope()
+		yOffset   = 0
 	)
-	for _, panel := range panels {
-		panelMap := panel.(map[string]interface{})
-		if panelMap["type"] == "row" || panelMap["end"] == true {
-			if len(repeatedPanels) > 0 {
-				repeatKey := repeatedPanels[0]["repeat"].(string)
-				if vals, err := vars.GetValues(repeatKey); err == nil {
-					ctx := vars.GetGlobalContext()
-					var baseOffset = panelsHeight(repeatedPanels)
-					for _, v := range vals {
-						// override the global context with local one
-						mergedCtx := mergeContext(ctx, v.Context)
-						mergedCtx[repeatKey] = v.Value
-						for _, p := range repeatedPanels {
-							x := renderMapWithVar(p, mergedCtx, yOffset)
-							newPanels = append(newPanels, x)
-						}
-						yOffset += baseOffset
-					}
-				} else {
-					newPanels = append(newPanels, repeatedPanels...)
-				}
+	for _, b := range splitRows(panels) {
+		rendered, grown, err := r.renderRowBlock(b, global, yOffset)
+		if err != nil {
+			return err
+		}
+		newPanels = append(newPanels, rendered...)
+		yOffset += grown
+	}
+
+	if err := layoutPanels(newPanels); err != nil {
+		return err
+	}
+
+	// update the panel ids, including the panels of the collapsed rows
+	var allPanels []map[string]interface{}
+	for _, panel := range newPanels {
+		allPanels = append(allPanels, panel)
+		allPanels = append(allPanels, panelMaps(panel["panels"])...)
+	}
+	r.assignPanelIDs(allPanels)
+
+	if err := r.validateAlerts(allPanels); err != nil {
+		return err
+	}
+	r.unmarkCopies(allPanels)
+
+	dashboard.Set("panels", newPanels)
+	return nil
+}
+
+const (
+	// repeatedPanelIDBase and repeatedPanelIDRange are the range of the IDs of the repeated copies,
+	// it's above the IDs of the template panels.
+	repeatedPanelIDBase  = 1000000
+	repeatedPanelIDRange = 1000000000
+)
+
+// assignPanelIDs sets the stable IDs of the rendered panels, a panel which isn't repeated keeps the ID of the
+// template panel, and a repeated copy gets the ID hashed from the template panel ID and the repeat values,
+// so the ID of a panel doesn't change unless the panel does. The IDs are unique, a taken ID moves to the next one,
+// and the panels without IDs in the template take the free IDs from 1.
+func (r *renderer) assignPanelIDs(panels []map[string]interface{}) {
+	// the template IDs are taken first, so they are never moved by the repeated copies
+	ids := make([]int, len(panels))
+	taken := make(map[int]bool, len(panels))
+	for i, p := range panels {
+		c, _ := r.copyOf(p)
+		if len(c.scope.repeats) == 0 && c.templateID > 0 && !taken[c.templateID] {
+			ids[i] = c.templateID
+			taken[c.templateID] = true
+		}
+	}
+	for i, p := range panels {
+		c, _ := r.copyOf(p)
+		if ids[i] != 0 || len(c.scope.repeats) == 0 {
+			continue
+		}
+		h := fnv.New64a()
+		_, _ = fmt.Fprint(h, c.templateID)
+		for _, name := range c.scope.repeats {
+			_, _ = fmt.Fprintf(h, "\x00%s\x00%v", name, c.scope.vars[name].values)
+		}
+		id := repeatedPanelIDBase + int(h.Sum64()%repeatedPanelIDRange)
+		for taken[id] {
+			id++
+		}
+		ids[i] = id
+		taken[id] = true
+	}
+	next := 1
+	for i, p := range panels {
+		if ids[i] == 0 {
+			for taken[next] {
+				next++
 			}
+			ids[i] = next
+			taken[next] = true
+		}
+		p["id"] = ids[i]
+	}
+}
+
+// copyKey is the key of the rendered panel where the renderer marks the index of its copy while rendering,
+// so the panel is matched with its copy even if a stage copies the panel.
+const copyKey = "__grafopsCopy"
+
+// markCopy records the rendered panel as a copy of the template panel with the variables in scope.
+func (r *renderer) markCopy(rendered, template map[string]interface{}, scope renderScope) {
+	rendered[copyKey] = len(r.copies)
+	r.copies = append(r.copies, panelCopy{
+		templateID: simplejson.NewFromAny(template).Get("id").MustInt(),
+		scope:      scope,
+		panel:      rendered,
+	})
+}
+
+// copyIndex returns the index of the copy the rendered panel is marked with.
+func (r *renderer) copyIndex(panel map[string]interface{}) (int, bool) {
+	i, err := simplejson.NewFromAny(panel).Get(copyKey).Int()
+	if err != nil || i < 0 || i >= len(r.copies) {
+		return 0, false
+	}
+	return i, true
+}
+
+// copyOf returns the copy the rendered panel is marked with.
+func (r *renderer) copyOf(panel map[string]interface{}) (panelCopy, bool) {
+	i, ok := r.copyIndex(panel)
+	if !ok {
+		return panelCopy{}, false
+	}
+	return r.copies[i], true
+}
+
+// unmarkCopies removes the marks from the rendered panels, the copies keep the final panels.
+func (r *renderer) unmarkCopies(panels []map[string]interface{}) {
+	for _, p := range panels {
+		if i, ok := r.copyIndex(p); ok {
+			r.copies[i].panel = p
+		}
+		delete(p, copyKey)
+	}
+}
+
+// rowBlock is a row with the panels in it, the row is nil for the panels above the first row.
+type rowBlock struct {
+	row    map[string]interface{}
+	panels []map[string]interface{}
+}
 
-			repeatedPanels = []map[string]interface{}{panelMap}
-		} else if len(repeatedPanels) > 0 {
-			repeatedPanels = append(repeatedPanels, panelMap)
+// splitRows splits the panels of the dashboard into the row blocks.
+func splitRows(panels []interface{}) []rowBlock {
+	var blocks []rowBlock
+	for _, panel := range panels {
+		panelMap, ok := panel.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if panelMap["type"] == "row" || len(blocks) == 0 {
+			blocks = append(blocks, rowBlock{})
+		}
+		b := &blocks[len(blocks)-1]
+		if panelMap["type"] == "row" {
+			b.row = panelMap
 		} else {
-			newPanels = append(newPanels, panelMap)
+			b.panels = append(b.panels, panelMap)
+		}
+	}
+	return blocks
+}
+
+// renderRowBlock renders the block once for each value of the row's repeat variable, one after another,
+// it returns the rendered panels moved down by yOffset and how much the block grows.
+func (r *renderer) renderRowBlock(b rowBlock, global renderScope, yOffset int) ([]map[string]interface{}, int, error) {
+	repeatVar, ok, err := r.repeatVar(b.row, global)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok {
+		return r.renderBlock(b, global, yOffset)
+	}
+
+	var (
+		rendered []map[string]interface{}
+		height   = blockHeight(b)
+		grown    = -height
+	)
+	for _, v := range repeatVar.Values {
+		// override the global context with local one
+		scope, err := r.repeatScope(global, repeatVar, v)
+		if err != nil {
+			return nil, 0, err
+		}
+		panels, extra, err := r.renderBlock(b, scope, yOffset+grown+height)
+		if err != nil {
+			return nil, 0, err
+		}
+		rendered = append(rendered, panels...)
+		grown += height + extra
+	}
+	return rendered, grown, nil
+}
+
+// renderBlock renders the row and its panels with the variables in scope, it returns the rendered panels
+// moved down by yOffset and how much the block grows by the repeated panels.
+// The panels of a collapsed row are nested in the row, they move with the row but never grow the block.
+func (r *renderer) renderBlock(b rowBlock, scope renderScope, yOffset int) ([]map[string]interface{}, int, error) {
+	var rendered []map[string]interface{}
+	if b.row != nil {
+		nested := panelMaps(b.row["panels"])
+		row := make(map[string]interface{}, len(b.row))
+		for k, v := range b.row {
+			if k != "panels" {
+				row[k] = v
+			}
+		}
+		row = r.renderMapWithVar(row, scope, yOffset)
+		r.markCopy(row, b.row, scope)
+		if nested != nil {
+			panels, _, err := r.renderPanelList(nested, scope, yOffset)
+			if err != nil {
+				return nil, 0, err
+			}
+			row["panels"] = panels
+		} else if panels, ok := b.row["panels"]; ok {
+			row["panels"] = panels
+		}
+		rendered = append(rendered, row)
+	}
+
+	panels, grown, err := r.renderPanelList(b.panels, scope, yOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return append(rendered, panels...), grown, nil
+}
+
+// renderPanelList renders the panels with the variables in scope, it returns the rendered panels
+// moved down by yOffset and how much they grow by the repeated panels.
+func (r *renderer) renderPanelList(panels []map[string]interface{}, scope renderScope,
+	yOffset int) ([]map[string]interface{}, int, error) {
+	// a repeated panel pushes down the panels below it
+	type expansion struct{ bottom, extra int }
+	var (
+		rendered   = make([]map[string]interface{}, 0, len(panels))
+		expansions []expansion
+		copies     = make([][]map[string]interface{}, len(panels))
+	)
+	for i, p := range panels {
+		var (
+			extra int
+			err   error
+		)
+		copies[i], extra, err = r.repeatPanel(p, scope)
+		if err != nil {
+			return nil, 0, err
+		}
+		if extra > 0 {
+			_, y, _, h := gridPos(p)
+			expansions = append(expansions, expansion{bottom: y + h, extra: extra})
+		}
+	}
+	for i, p := range panels {
+		_, y, _, _ := gridPos(p)
+		offset := yOffset
+		for _, e := range expansions {
+			if e.bottom <= y {
+				offset += e.extra
+			}
+		}
+		for _, c := range copies[i] {
+			moveDown(c, offset)
+			rendered = append(rendered, c)
+		}
+	}
+	// the panels repeated side by side grow the block once
+	grown := 0
+	if len(expansions) > 0 {
+		grown = panelsBottom(rendered) - yOffset - panelsBottom(panels)
+	}
+	return rendered, grown, nil
+}
+
+// panelMaps returns the panels in the panels field of a row, it's nil if there are none.
+func panelMaps(v interface{}) []map[string]interface{} {
+	var panels []map[string]interface{}
+	switch val := v.(type) {
+	case []interface{}:
+		for _, p := range val {
+			if pMap, ok := p.(map[string]interface{}); ok {
+				panels = append(panels, pMap)
+			}
+		}
+	case []map[string]interface{}:
+		panels = val
+	}
+	if len(panels) == 0 {
+		return nil
+	}
+	return panels
+}
+
+// repeatPanel renders the panel once for each value of its repeat variable, the copies are laid out
+// horizontally across the grid with at most maxPerRow in a row, or stacked vertically by repeatDirection.
+// It returns the rendered copies and how much taller they are than the panel.
+func (r *renderer) repeatPanel(p map[string]interface{}, scope renderScope) ([]map[string]interface{}, int, error) {
+	repeatVar, ok, err := r.repeatVar(p, scope)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !ok || len(repeatVar.Values) == 0 {
+		return []map[string]interface{}{r.renderPanel(p, scope)}, 0, nil
+	}
+
+	var (
+		pSimple      = simplejson.NewFromAny(p)
+		x, y, w, h   = gridPos(p)
+		n            = len(repeatVar.Values)
+		vertical     = pSimple.Get("repeatDirection").MustString() == "v"
+		maxPerRow    = pSimple.Get("maxPerRow").MustInt(defaultMaxPerRow)
+		copies       []map[string]interface{}
+		perRow, rows int
+	)
+	if maxPerRow <= 0 {
+		maxPerRow = defaultMaxPerRow
+	}
+	if vertical {
+		perRow, rows = 1, n
+	} else {
+		perRow = n
+		if perRow > maxPerRow {
+			perRow = maxPerRow
 		}
+		rows = (n + perRow - 1) / perRow
+		w = gridColumnCount / perRow
 	}
 
-	// update the panel ids
-	for i, panel := range newPanels {
-		panel["id"] = i + 1
+	for i, v := range repeatVar.Values {
+		copyScope, err := r.repeatScope(scope, repeatVar, v)
+		if err != nil {
+			return nil, 0, err
+		}
+		c := r.renderPanel(p, copyScope)
+		if vertical {
+			setGridPos(c, x, y+i*h, w, h)
+		} else {
+			setGridPos(c, (i%perRow)*w, y+(i/perRow)*h, w, h)
+		}
+		copies = append(copies, c)
 	}
+	return copies, (rows - 1) * h, nil
+}
 
-	jsonBody.Set("panels", newPanels)
-	return jsonBody.Encode()
+// renderPanel returns a copy of the panel rendered with the variables in scope.
+func (r *renderer) renderPanel(p map[string]interface{}, scope renderScope) map[string]interface{} {
+	rendered := r.renderMapWithVar(p, scope, 0)
+	r.renderAlert(rendered, p, scope)
+	r.markCopy(rendered, p, scope)
+	return rendered
 }
 
-// panelsHeight calculates the total height of the panels
-func panelsHeight(repeatedPanels []map[string]interface{}) int {
-	var maxY = 0
-	var minY = math.MaxInt32
-	for _, p := range repeatedPanels {
-		pMap := simplejson.NewFromAny(p)
-		y, _ := pMap.GetPath("gridPos", "y").Int()
-		h, _ := pMap.GetPath("gridPos", "h").Int()
-		if y < minY {
-			minY = y
+// repeatVar returns the var the panel or row is repeated by in the scope, it's the var of the outer value
+// if the value has its own, and only the values passing the filter of the var are kept.
+func (r *renderer) repeatVar(p map[string]interface{}, scope renderScope) (Var, bool, error) {
+	repeatKey, _ := p["repeat"].(string)
+	if repeatKey == "" {
+		return Var{}, false, nil
+	}
+	v, ok := scope.nested[repeatKey]
+	if !ok {
+		if v, ok = r.vars.getVar(repeatKey); !ok {
+			return Var{}, false, nil
 		}
-		if y+h > maxY {
-			maxY = y + h
+	}
+	filtered, err := filterVar(v, scope)
+	if err != nil {
+		return Var{}, false, err
+	}
+	return filtered, true, nil
+}
+
+// filterVar returns the var with only the values passing its filter in the scope.
+func filterVar(v Var, scope renderScope) (Var, error) {
+	if v.Filter == "" {
+		return v, nil
+	}
+	filtered := v
+	filtered.Values = nil
+	for _, val := range v.Values {
+		keep, err := filterVal(v, val, scope)
+		if err != nil {
+			return Var{}, err
+		}
+		if keep {
+			filtered.Values = append(filtered.Values, val)
 		}
 	}
-	return maxY - minY
+	return filtered, nil
 }
 
-func renderMapWithVar(m map[string]interface{}, ctx map[string]string, yOffset int) (res map[string]interface{}) {
-	mSimple := simplejson.NewFromAny(m)
-	y, _ := mSimple.GetPath("gridPos", "y").Int()
-	mSimple.SetPath([]string{"gridPos", "y"}, y+yOffset)
+// filterVal tells if the val of the var passes the filter of the var in the scope.
+func filterVal(v Var, val Val, scope renderScope) (bool, error) {
+	data := make(map[string]string, len(scope.vars)+len(val.Context)+1)
+	for name, sv := range scope.vars {
+		data[name] = strings.Join(sv.values, "+")
+	}
+	for name, value := range val.Context {
+		data[name] = value
+	}
+	data[v.Name] = val.Value
+	if len(val.Values) > 0 {
+		data[v.Name] = strings.Join(val.Values, "+")
+	}
 
-	marshalled, _ := mSimple.Encode()
-	marshalledStr := string(marshalled)
-	for k, v := range ctx {
-		marshalledStr = replaceVar(marshalledStr, k, v)
+	executed, err := executePattern(v.Filter, data)
+	if err != nil {
+		return false, fmt.Errorf("fail to filter the var %s: %w", v.Name, err)
 	}
+	keep, err := strconv.ParseBool(strings.TrimSpace(executed))
+	if err != nil {
+		return false, fmt.Errorf("the filter of the var %s should be true or false, but it's %q", v.Name, executed)
+	}
+	return keep, nil
+}
+
+const (
+	// gridColumnCount is the width of the Grafana dashboard grid.
+	gridColumnCount = 24
+	// defaultMaxPerRow is the default max number of the horizontally repeated panels in a row.
+	defaultMaxPerRow = 4
+)
+
+// gridPos returns the position and size of the panel in the grid.
+func gridPos(p map[string]interface{}) (x, y, w, h int) {
+	pos := simplejson.NewFromAny(p).Get("gridPos")
+	return pos.Get("x").MustInt(), pos.Get("y").MustInt(), pos.Get("w").MustInt(), pos.Get("h").MustInt()
+}
+
+func setGridPos(p map[string]interface{}, x, y, w, h int) {
+	p["gridPos"] = map[string]interface{}{"x": x, "y": y, "w": w, "h": h}
+}
+
+// moveDown moves the panel down by yOffset.
+func moveDown(p map[string]interface{}, yOffset int) {
+	if yOffset == 0 {
+		return
+	}
+	pSimple := simplejson.NewFromAny(p)
+	y, _ := pSimple.GetPath("gridPos", "y").Int()
+	pSimple.SetPath([]string{"gridPos", "y"}, y+yOffset)
+}
+
+// blockHeight returns the height of the row block from the top of the row to the bottom of its panels,
+// including the space between the row and the panels.
+func blockHeight(b rowBlock) int {
+	_, top, _, _ := gridPos(b.row)
+	if bottom := panelsBottom(append([]map[string]interface{}{b.row}, b.panels...)); bottom > top {
+		return bottom - top
+	}
+	return 0
+}
 
-	// recover
-	mSimple.SetPath([]string{"gridPos", "y"}, y)
+// panelsBottom returns the bottom of the lowest panel in the grid.
+func panelsBottom(panels []map[string]interface{}) int {
+	bottom := 0
+	for _, p := range panels {
+		_, y, _, h := gridPos(p)
+		if y+h > bottom {
+			bottom = y + h
+		}
+	}
+	return bottom
+}
 
-	_ = json.Unmarshal([]byte(marshalledStr), &res)
+// renderMapWithVar returns a copy of the panel with the variables replaced and moved down by yOffset.
+func (r *renderer) renderMapWithVar(m map[string]interface{}, scope renderScope, yOffset int) map[string]interface{} {
+	res := renderStrings(m, r.datasources, func(s string, datasource string) string {
+		return interpolate(s, scope.vars, datasource)
+	}).(map[string]interface{})
+	moveDown(res, yOffset)
 	return res
 }
 
-func replaceVar(template string, key string, val string) string {
-	template = strings.ReplaceAll(template, "$"+key, val)
-	template = strings.ReplaceAll(template, "${"+key+"}", val)
-	return template
+// renderStrings returns a deep copy of the decoded JSON value with fn applied to every string leaf,
+// the variables are substituted into the decoded strings so the values never need JSON escaping.
+// The strings in the panel targets are given the type of the closest datasource, if it's known by the datasource
+// field or the types of the datasource references, because the targets are the queries sent to the datasource.
+func renderStrings(v interface{}, types map[string]string, fn func(s string, datasource string) string) interface{} {
+	return renderStringsIn(v, types, "", false, fn)
+}
+
+func renderStringsIn(v interface{}, types map[string]string, datasource string, inTargets bool,
+	fn func(s string, datasource string) string) interface{} {
+	switch val := v.(type) {
+	case string:
+		if !inTargets {
+			return fn(val, "")
+		}
+		return fn(val, datasource)
+	case map[string]interface{}:
+		if t := datasourceType(val["datasource"], types); t != "" {
+			datasource = t
+		}
+		res := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			res[k] = renderStringsIn(item, types, datasource, inTargets || k == "targets", fn)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = renderStringsIn(item, types, datasource, inTargets, fn)
+		}
+		return res
+	case []map[string]interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			res[i] = renderStringsIn(item, types, datasource, inTargets, fn)
+		}
+		return res
+	default:
+		return val
+	}
 }
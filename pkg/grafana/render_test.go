@@ -1,8 +1,12 @@
 package grafana
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/songrgg/grafops/pkg/simplejson"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -267,7 +271,7 @@ const body = `
 }
 `
 
-const ExpectedRendered = `{"annotations":{"list":[{"builtIn":1,"datasource":"-- Grafana --","enable":true,"hide":true,"iconColor":"rgba(0, 211, 255, 1)","name":"Annotations \u0026 Alerts","type":"dashboard"}]},"editable":true,"gnetId":null,"graphTooltip":0,"id":2,"iteration":1584819938476,"links":[],"panels":[{"collapsed":false,"datasource":null,"gridPos":{"h":1,"w":24,"x":0,"y":0},"id":1,"panels":[],"repeat":"SERVICE_NAME","scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"title":"news","type":"row"},{"content":"This is news dashboard.\n\nHere's the variable TEST_VAR= \"local_news\".","datasource":"myinfluxdb","description":"This is news dashboard.","gridPos":{"h":8,"w":12,"x":0,"y":1},"id":2,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'news', 'local_news' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"news","type":"text"},{"content":"Nothing on this.\n\n\n\n","datasource":"myinfluxdb","description":"This is news dashboard.","gridPos":{"h":8,"w":17,"x":3,"y":9},"id":3,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'news' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"news ----- 2","type":"text"},{"collapsed":false,"datasource":null,"gridPos":{"h":1,"w":24,"x":0,"y":17},"id":4,"panels":[],"repeat":"SERVICE_NAME","scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"title":"payment","type":"row"},{"content":"This is payment dashboard.\n\nHere's the variable TEST_VAR= \"local_payment\".","datasource":"myinfluxdb","description":"This is payment dashboard.","gridPos":{"h":8,"w":12,"x":0,"y":18},"id":5,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'payment', 'local_payment' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"payment","type":"text"},{"content":"Nothing on this.\n\n\n\n","datasource":"myinfluxdb","description":"This is payment dashboard.","gridPos":{"h":8,"w":17,"x":3,"y":26},"id":6,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'payment' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"payment ----- 2","type":"text"},{"collapsed":false,"datasource":null,"gridPos":{"h":1,"w":24,"x":0,"y":34},"id":7,"panels":[],"repeat":"SERVICE_NAME","scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"title":"user","type":"row"},{"content":"This is user dashboard.\n\nHere's the variable TEST_VAR= \"global\".","datasource":"myinfluxdb","description":"This is user dashboard.","gridPos":{"h":8,"w":12,"x":0,"y":35},"id":8,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'user', 'global' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"user","type":"text"},{"content":"Nothing on this.\n\n\n\n","datasource":"myinfluxdb","description":"This is user dashboard.","gridPos":{"h":8,"w":17,"x":3,"y":43},"id":9,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'user' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"user ----- 2","type":"text"}],"schemaVersion":22,"style":"dark","tags":[],"templating":{"list":[{"allValue":null,"current":{"selected":false,"text":"news","value":"news"},"hide":0,"includeAll":false,"label":"Service Name","multi":false,"name":"SERVICE_NAME","options":[{"selected":true,"text":"news","value":"news"},{"selected":false,"text":"payment","value":"payment"},{"selected":false,"text":"user","value":"user"}],"query":"news,payment,user","skipUrlSync":false,"type":"custom"},{"allValue":null,"current":{"selected":false,"text":"global","value":"global"},"hide":0,"includeAll":false,"label":null,"multi":false,"name":"TEST_VAR","options":[{"selected":true,"text":"global","value":"global"}],"query":"global","skipUrlSync":false,"type":"custom"}]},"time":{"from":"now-6h","to":"now"},"timepicker":{"refresh_intervals":["5s","10s","30s","1m","5m","15m","30m","1h","2h","1d"]},"timezone":"","title":" service monitoring","uid":"VoUygmrWz","version":10}`
+const ExpectedRendered = `{"annotations":{"list":[{"builtIn":1,"datasource":"-- Grafana --","enable":true,"hide":true,"iconColor":"rgba(0, 211, 255, 1)","name":"Annotations \u0026 Alerts","type":"dashboard"}]},"editable":true,"gnetId":null,"graphTooltip":0,"id":2,"iteration":1584819938476,"links":[],"panels":[{"collapsed":false,"datasource":null,"gridPos":{"h":1,"w":24,"x":0,"y":0},"id":687035777,"panels":[],"repeat":"SERVICE_NAME","scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"title":"news","type":"row"},{"content":"This is news dashboard.\n\nHere's the variable TEST_VAR= \"local_news\".","datasource":"myinfluxdb","description":"This is news dashboard.","gridPos":{"h":8,"w":12,"x":0,"y":1},"id":804038895,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'news', 'local_news' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"news","type":"text"},{"content":"Nothing on this.\n\n\n\n","datasource":"myinfluxdb","description":"This is news dashboard.","gridPos":{"h":8,"w":17,"x":3,"y":9},"id":334809280,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'news' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"news ----- 2","type":"text"},{"collapsed":false,"datasource":null,"gridPos":{"h":1,"w":24,"x":0,"y":17},"id":199460100,"panels":[],"repeat":"SERVICE_NAME","scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"title":"payment","type":"row"},{"content":"This is payment dashboard.\n\nHere's the variable TEST_VAR= \"local_payment\".","datasource":"myinfluxdb","description":"This is payment dashboard.","gridPos":{"h":8,"w":12,"x":0,"y":18},"id":600179414,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'payment', 'local_payment' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"payment","type":"text"},{"content":"Nothing on this.\n\n\n\n","datasource":"myinfluxdb","description":"This is payment dashboard.","gridPos":{"h":8,"w":17,"x":3,"y":26},"id":276960415,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'payment' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"payment ----- 2","type":"text"},{"collapsed":false,"datasource":null,"gridPos":{"h":1,"w":24,"x":0,"y":34},"id":33275101,"panels":[],"repeat":"SERVICE_NAME","scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"title":"user","type":"row"},{"content":"This is user dashboard.\n\nHere's the variable TEST_VAR= \"global\".","datasource":"myinfluxdb","description":"This is user dashboard.","gridPos":{"h":8,"w":12,"x":0,"y":35},"id":231722175,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'user', 'global' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"user","type":"text"},{"content":"Nothing on this.\n\n\n\n","datasource":"myinfluxdb","description":"This is user dashboard.","gridPos":{"h":8,"w":17,"x":3,"y":43},"id":232099928,"mode":"markdown","options":{},"scopedVars":{"SERVICE_NAME":{"selected":true,"text":"news","value":"news"}},"targets":[{"groupBy":[{"params":["$__interval"],"type":"time"},{"params":["null"],"type":"fill"}],"orderByTime":"ASC","policy":"default","query":"SELECT 'user' FROM \"http_req_duration\" WHERE $timeFilter GROUP BY time($__interval) fill(null)","rawQuery":true,"refId":"A","resultFormat":"time_series","select":[[{"params":["value"],"type":"field"},{"params":[],"type":"mean"}]],"tags":[]}],"timeFrom":null,"timeShift":null,"title":"user ----- 2","type":"text"}],"schemaVersion":22,"style":"dark","tags":[],"templating":{"list":[{"allValue":null,"current":{"selected":false,"text":"news","value":"news"},"hide":0,"includeAll":false,"label":"Service Name","multi":false,"name":"SERVICE_NAME","options":[{"selected":true,"text":"news","value":"news"},{"selected":false,"text":"payment","value":"payment"},{"selected":false,"text":"user","value":"user"}],"query":"news,payment,user","skipUrlSync":false,"type":"custom"},{"allValue":null,"current":{"selected":false,"text":"global","value":"global"},"hide":0,"includeAll":false,"label":null,"multi":false,"name":"TEST_VAR","options":[{"selected":true,"text":"global","value":"global"}],"query":"global","skipUrlSync":false,"type":"custom"}]},"time":{"from":"now-6h","to":"now"},"timepicker":{"refresh_intervals":["5s","10s","30s","1m","5m","15m","30m","1h","2h","1d"]},"timezone":"","title":" service monitoring","uid":"VoUygmrWz","version":10}`
 
 func TestUpdateDashboardWithTemplate(t *testing.T) {
 	err := RenderDashboardWithTemplate(UpdateConfig{
@@ -347,3 +351,443 @@ func TestRenderDashboard(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, []byte(ExpectedRendered), rendered)
 }
+
+func TestRenderDashboardEscaping(t *testing.T) {
+	dashboard := `{
+  "panels": [
+    {"type": "row", "repeat": "MATCHER", "title": "$MATCHER", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+    {"type": "graph", "title": "$MATCHER", "gridPos": {"h": 8, "w": 24, "x": 0, "y": 1},
+     "targets": [{"expr": "up{$MATCHER}", "refId": "A"}]}
+  ],
+  "title": "$GLOBAL"
+}`
+	values := []string{`service=~"a|b"`, `path="C:\\temp"`, "multi\nline", `{"json": true}`}
+	var vals []Val
+	for _, v := range values {
+		vals = append(vals, Val{Value: v})
+	}
+
+	rendered, err := RenderDashboard([]byte(dashboard), RenderVars{
+		{Name: "MATCHER", Values: vals},
+		{Name: "GLOBAL", Values: []Val{{Value: `"quoted" \ title`}}},
+	})
+	assert.Nil(t, err)
+
+	var result struct {
+		Title  string `json:"title"`
+		Panels []struct {
+			Title   string `json:"title"`
+			Targets []struct {
+				Expr string `json:"expr"`
+			} `json:"targets"`
+		} `json:"panels"`
+	}
+	assert.Nil(t, json.Unmarshal(rendered, &result))
+	assert.Equal(t, `"quoted" \ title`, result.Title)
+	assert.Len(t, result.Panels, 2*len(values))
+	for i, v := range values {
+		assert.Equal(t, v, result.Panels[2*i].Title)
+		assert.Equal(t, v, result.Panels[2*i+1].Title)
+		assert.Equal(t, "up{"+v+"}", result.Panels[2*i+1].Targets[0].Expr)
+	}
+}
+
+type renderedPanel struct {
+	ID      int    `json:"id"`
+	Title   string `json:"title"`
+	GridPos struct {
+		H int `json:"h"`
+		W int `json:"w"`
+		X int `json:"x"`
+		Y int `json:"y"`
+	} `json:"gridPos"`
+}
+
+func renderPanelsOf(t *testing.T, dashboard string, vars RenderVars) []renderedPanel {
+	rendered, err := RenderDashboard([]byte(dashboard), vars)
+	assert.Nil(t, err)
+
+	var result struct {
+		Panels []renderedPanel `json:"panels"`
+	}
+	assert.Nil(t, json.Unmarshal(rendered, &result))
+	return result.Panels
+}
+
+func panelLayout(panels []renderedPanel) []string {
+	var layout []string
+	for _, p := range panels {
+		layout = append(layout, fmt.Sprintf("%s x=%d y=%d w=%d h=%d", p.Title, p.GridPos.X, p.GridPos.Y, p.GridPos.W, p.GridPos.H))
+	}
+	return layout
+}
+
+func TestRenderDashboardPanelRepeat(t *testing.T) {
+	services := RenderVars{
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "a"}, {Value: "b"}, {Value: "c"}, {Value: "d"}, {Value: "e"}}},
+	}
+
+	tests := []struct {
+		name      string
+		dashboard string
+		expected  []string
+	}{
+		{
+			name: "horizontal repeat wraps by maxPerRow",
+			dashboard: `{"panels": [
+  {"type": "graph", "title": "top", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 0}},
+  {"type": "graph", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "repeatDirection": "h", "maxPerRow": 3,
+   "gridPos": {"h": 8, "w": 12, "x": 0, "y": 2}},
+  {"type": "graph", "title": "below", "gridPos": {"h": 4, "w": 24, "x": 0, "y": 10}}
+]}`,
+			expected: []string{
+				"top x=0 y=0 w=24 h=2",
+				"a x=0 y=2 w=8 h=8",
+				"b x=8 y=2 w=8 h=8",
+				"c x=16 y=2 w=8 h=8",
+				"d x=0 y=10 w=8 h=8",
+				"e x=8 y=10 w=8 h=8",
+				"below x=0 y=18 w=24 h=4",
+			},
+		},
+		{
+			name: "horizontal repeat defaults to 4 per row",
+			dashboard: `{"panels": [
+  {"type": "graph", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 8, "w": 12, "x": 0, "y": 0}}
+]}`,
+			expected: []string{
+				"a x=0 y=0 w=6 h=8",
+				"b x=6 y=0 w=6 h=8",
+				"c x=12 y=0 w=6 h=8",
+				"d x=18 y=0 w=6 h=8",
+				"e x=0 y=8 w=6 h=8",
+			},
+		},
+		{
+			name: "vertical repeat stacks the panels",
+			dashboard: `{"panels": [
+  {"type": "graph", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "repeatDirection": "v",
+   "gridPos": {"h": 3, "w": 12, "x": 6, "y": 0}},
+  {"type": "graph", "title": "below", "gridPos": {"h": 4, "w": 24, "x": 0, "y": 3}}
+]}`,
+			expected: []string{
+				"a x=6 y=0 w=12 h=3",
+				"b x=6 y=3 w=12 h=3",
+				"c x=6 y=6 w=12 h=3",
+				"d x=6 y=9 w=12 h=3",
+				"e x=6 y=12 w=12 h=3",
+				"below x=0 y=15 w=24 h=4",
+			},
+		},
+		{
+			name: "panel repeat in a row shifts the following rows",
+			dashboard: `{"panels": [
+  {"type": "row", "title": "first", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "graph", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "repeatDirection": "v",
+   "gridPos": {"h": 2, "w": 24, "x": 0, "y": 1}},
+  {"type": "row", "title": "second", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 3}},
+  {"type": "graph", "title": "last", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 4}}
+]}`,
+			expected: []string{
+				"first x=0 y=0 w=24 h=1",
+				"a x=0 y=1 w=24 h=2",
+				"b x=0 y=3 w=24 h=2",
+				"c x=0 y=5 w=24 h=2",
+				"d x=0 y=7 w=24 h=2",
+				"e x=0 y=9 w=24 h=2",
+				"second x=0 y=11 w=24 h=1",
+				"last x=0 y=12 w=24 h=2",
+			},
+		},
+		{
+			name: "repeated row shifts the following rows",
+			dashboard: `{"panels": [
+  {"type": "row", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "graph", "title": "$SERVICE_NAME graph", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 1}},
+  {"type": "row", "title": "not repeated", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 3}},
+  {"type": "graph", "title": "last", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 4}}
+]}`,
+			expected: []string{
+				"a x=0 y=0 w=24 h=1",
+				"a graph x=0 y=1 w=24 h=2",
+				"b x=0 y=3 w=24 h=1",
+				"b graph x=0 y=4 w=24 h=2",
+				"c x=0 y=6 w=24 h=1",
+				"c graph x=0 y=7 w=24 h=2",
+				"d x=0 y=9 w=24 h=1",
+				"d graph x=0 y=10 w=24 h=2",
+				"e x=0 y=12 w=24 h=1",
+				"e graph x=0 y=13 w=24 h=2",
+				"not repeated x=0 y=15 w=24 h=1",
+				"last x=0 y=16 w=24 h=2",
+			},
+		},
+		{
+			name: "repeated row keeps the x offsets of mixed widths and closes the gap below the row",
+			dashboard: `{"panels": [
+  {"type": "row", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "graph", "title": "$SERVICE_NAME left", "gridPos": {"h": 3, "w": 8, "x": 0, "y": 2}},
+  {"type": "graph", "title": "$SERVICE_NAME right", "gridPos": {"h": 5, "w": 14, "x": 10, "y": 3}},
+  {"type": "graph", "title": "$SERVICE_NAME under", "gridPos": {"h": 2, "w": 8, "x": 0, "y": 5}},
+  {"type": "row", "title": "end", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 8}}
+]}`,
+			expected: []string{
+				"a x=0 y=0 w=24 h=1",
+				"a left x=0 y=1 w=8 h=3",
+				"a right x=10 y=1 w=14 h=5",
+				"a under x=0 y=4 w=8 h=2",
+				"b x=0 y=6 w=24 h=1",
+				"b left x=0 y=7 w=8 h=3",
+				"b right x=10 y=7 w=14 h=5",
+				"b under x=0 y=10 w=8 h=2",
+				"c x=0 y=12 w=24 h=1",
+				"c left x=0 y=13 w=8 h=3",
+				"c right x=10 y=13 w=14 h=5",
+				"c under x=0 y=16 w=8 h=2",
+				"d x=0 y=18 w=24 h=1",
+				"d left x=0 y=19 w=8 h=3",
+				"d right x=10 y=19 w=14 h=5",
+				"d under x=0 y=22 w=8 h=2",
+				"e x=0 y=24 w=24 h=1",
+				"e left x=0 y=25 w=8 h=3",
+				"e right x=10 y=25 w=14 h=5",
+				"e under x=0 y=28 w=8 h=2",
+				"end x=0 y=30 w=24 h=1",
+			},
+		},
+		{
+			name: "vertical repeat next to a panel pushes down only the panels below it",
+			dashboard: `{"panels": [
+  {"type": "graph", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "repeatDirection": "v",
+   "gridPos": {"h": 2, "w": 12, "x": 0, "y": 0}},
+  {"type": "graph", "title": "side", "gridPos": {"h": 4, "w": 12, "x": 12, "y": 0}},
+  {"type": "graph", "title": "under side", "gridPos": {"h": 4, "w": 12, "x": 12, "y": 4}},
+  {"type": "graph", "title": "below", "gridPos": {"h": 4, "w": 24, "x": 0, "y": 8}}
+]}`,
+			expected: []string{
+				"a x=0 y=0 w=12 h=2",
+				"b x=0 y=2 w=12 h=2",
+				"c x=0 y=4 w=12 h=2",
+				"d x=0 y=6 w=12 h=2",
+				"e x=0 y=8 w=12 h=2",
+				"side x=12 y=0 w=12 h=4",
+				"under side x=12 y=4 w=12 h=4",
+				"below x=0 y=10 w=24 h=4",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, panelLayout(renderPanelsOf(t, tt.dashboard, services)), tt.name)
+	}
+}
+
+func TestRenderDashboardCollapsedRow(t *testing.T) {
+	dashboard := `{"panels": [
+  {"type": "row", "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "collapsed": true,
+   "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0},
+   "panels": [
+     {"type": "graph", "title": "$SERVICE_NAME $ENV", "gridPos": {"h": 4, "w": 24, "x": 0, "y": 1}},
+     {"type": "graph", "title": "$SERVICE_NAME $ENV", "repeat": "ENV", "repeatDirection": "v",
+      "gridPos": {"h": 2, "w": 24, "x": 0, "y": 5}},
+     {"type": "graph", "title": "bottom of $SERVICE_NAME", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 7}}
+   ]},
+  {"type": "row", "title": "expanded", "collapsed": false, "panels": [], "gridPos": {"h": 1, "w": 24, "x": 0, "y": 1}},
+  {"type": "graph", "title": "last", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 2}}
+]}`
+	vars := RenderVars{
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}},
+		{Name: "ENV", Values: []Val{{Value: "prod"}, {Value: "dev"}}},
+	}
+
+	rendered, err := RenderDashboard([]byte(dashboard), vars)
+	assert.Nil(t, err)
+
+	var result struct {
+		Panels []struct {
+			renderedPanel
+			ID        int             `json:"id"`
+			Collapsed bool            `json:"collapsed"`
+			Panels    []renderedPanel `json:"panels"`
+		} `json:"panels"`
+	}
+	assert.Nil(t, json.Unmarshal(rendered, &result))
+
+	var top []renderedPanel
+	for _, p := range result.Panels {
+		top = append(top, p.renderedPanel)
+	}
+	assert.Equal(t, []string{
+		"news x=0 y=0 w=24 h=1",
+		"payment x=0 y=1 w=24 h=1",
+		"expanded x=0 y=2 w=24 h=1",
+		"last x=0 y=3 w=24 h=2",
+	}, panelLayout(top))
+
+	assert.True(t, result.Panels[0].Collapsed)
+	assert.True(t, result.Panels[1].Collapsed)
+	assert.False(t, result.Panels[2].Collapsed)
+	assert.Equal(t, []string{
+		"news prod x=0 y=1 w=24 h=4",
+		"news prod x=0 y=5 w=24 h=2",
+		"news dev x=0 y=7 w=24 h=2",
+		"bottom of news x=0 y=9 w=24 h=2",
+	}, panelLayout(result.Panels[0].Panels))
+	assert.Equal(t, []string{
+		"payment prod x=0 y=2 w=24 h=4",
+		"payment prod x=0 y=6 w=24 h=2",
+		"payment dev x=0 y=8 w=24 h=2",
+		"bottom of payment x=0 y=10 w=24 h=2",
+	}, panelLayout(result.Panels[1].Panels))
+
+	// the panel ids are unique including the nested panels
+	ids := make(map[int]bool)
+	for _, p := range result.Panels {
+		ids[p.ID] = true
+		for _, nested := range p.Panels {
+			ids[nested.ID] = true
+		}
+	}
+	assert.Len(t, ids, 12)
+	assert.False(t, ids[0])
+}
+
+func TestRenderDashboardStablePanelIDs(t *testing.T) {
+	template := `{"panels": [
+  {"type": "graph", "id": 7, "title": "overview", "gridPos": {"h": 2, "w": 12, "x": 0, "y": 0}},
+  {"type": "row", "id": 1, "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 2}},
+  {"type": "graph", "id": 2, "title": "$SERVICE_NAME latency", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 3}}
+]}`
+	idsOf := func(dashboard string, values ...string) map[string]int {
+		vars := RenderVars{{Name: "SERVICE_NAME"}}
+		for _, v := range values {
+			vars[0].Values = append(vars[0].Values, Val{Value: v})
+		}
+		ids := make(map[string]int)
+		for _, p := range renderPanelsOf(t, dashboard, vars) {
+			assert.NotContains(t, ids, p.Title)
+			ids[p.Title] = p.ID
+		}
+		return ids
+	}
+
+	ids := idsOf(template, "news", "payment")
+	assert.Len(t, ids, 5)
+	// the panel which isn't repeated keeps its ID
+	assert.Equal(t, 7, ids["overview"])
+	unique := make(map[int]bool)
+	for _, id := range ids {
+		unique[id] = true
+	}
+	assert.Len(t, unique, 5)
+
+	// adding a value or a panel doesn't change the IDs of the other panels
+	grown := idsOf(strings.Replace(template, `"panels": [`,
+		`"panels": [{"type": "text", "id": 3, "title": "about", "gridPos": {"h": 2, "w": 12, "x": 12, "y": 0}},`, 1),
+		"user", "news", "payment")
+	for title, id := range ids {
+		assert.Equal(t, id, grown[title], title)
+	}
+	assert.Equal(t, 3, grown["about"])
+}
+
+func TestAssignPanelIDsOfCopiedPanels(t *testing.T) {
+	template := `{"panels": [
+  {"type": "graph", "id": 7, "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 2, "w": 12, "x": 0, "y": 0}}
+]}`
+	dashboard, err := simplejson.NewJson([]byte(template))
+	assert.Nil(t, err)
+	vars := RenderVars{{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}, {Value: "payment"}}}}
+	r := newRenderer(dashboard, vars, RenderOptions{})
+	panels, _, err := r.renderPanelList(panelMaps(dashboard.Get("panels").MustArray()), r.globalScope(), 0)
+	assert.Nil(t, err)
+
+	// the copies are found by their marks, not by the maps
+	copied := make([]map[string]interface{}, len(panels))
+	for i, p := range panels {
+		copied[i] = make(map[string]interface{}, len(p))
+		for k, v := range p {
+			copied[i][k] = v
+		}
+	}
+	r.assignPanelIDs(copied)
+	r.unmarkCopies(copied)
+	assert.NotEqual(t, copied[0]["id"], copied[1]["id"])
+	assert.Greater(t, copied[0]["id"], repeatedPanelIDBase)
+	for i, p := range copied {
+		assert.NotContains(t, p, copyKey)
+		assert.Equal(t, p["id"], r.copies[i].panel["id"])
+	}
+}
+
+func TestRenderDashboardNestedRepeat(t *testing.T) {
+	dashboard := `{"panels": [
+  {"type": "row", "id": 1, "title": "$REGION", "repeat": "REGION", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "graph", "id": 2, "title": "$SERVICE_NAME in $REGION", "repeat": "SERVICE_NAME",
+   "gridPos": {"h": 4, "w": 12, "x": 0, "y": 1}},
+  {"type": "graph", "id": 3, "title": "$SERVICE_NAME of $REGION", "gridPos": {"h": 2, "w": 24, "x": 0, "y": 5}}
+]}`
+
+	// the services are listed in the values of the regions
+	nested := RenderVars{
+		{Name: "REGION", Values: []Val{
+			{Value: "eu", Vars: RenderVars{
+				{Name: "SERVICE_NAME", Multi: true, Values: []Val{{Value: "news"}, {Value: "payment"}}},
+			}},
+			{Value: "us", Vars: RenderVars{
+				{Name: "SERVICE_NAME", Values: []Val{{Value: "user"}}},
+			}},
+		}},
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "all"}}},
+	}
+	expected := []string{
+		"eu x=0 y=0 w=24 h=1",
+		"news in eu x=0 y=1 w=12 h=4",
+		"payment in eu x=12 y=1 w=12 h=4",
+		"{news,payment} of eu x=0 y=5 w=24 h=2",
+		"us x=0 y=7 w=24 h=1",
+		"user in us x=0 y=8 w=24 h=4",
+		"user of us x=0 y=12 w=24 h=2",
+	}
+	panels := renderPanelsOf(t, dashboard, nested)
+	assert.Equal(t, expected, panelLayout(panels))
+
+	// the copies are told apart by both repeat values
+	ids := make(map[int]bool)
+	for _, p := range panels {
+		ids[p.ID] = true
+	}
+	assert.Len(t, ids, len(panels))
+
+	// the services are filtered by the region in their context
+	filtered := RenderVars{
+		{Name: "REGION", Values: []Val{{Value: "eu"}, {Value: "us"}}},
+		{Name: "SERVICE_NAME", Filter: "{{eq .SERVICE_REGION .REGION}}", Values: []Val{
+			{Value: "news", Context: map[string]string{"SERVICE_REGION": "eu"}},
+			{Value: "user", Context: map[string]string{"SERVICE_REGION": "us"}},
+			{Value: "payment", Context: map[string]string{"SERVICE_REGION": "eu"}},
+		}},
+	}
+	assert.Equal(t, []string{
+		"eu x=0 y=0 w=24 h=1",
+		"news in eu x=0 y=1 w=12 h=4",
+		"payment in eu x=12 y=1 w=12 h=4",
+		"news of eu x=0 y=5 w=24 h=2",
+		"us x=0 y=7 w=24 h=1",
+		"user in us x=0 y=8 w=24 h=4",
+		"user of us x=0 y=12 w=24 h=2",
+	}, panelLayout(renderPanelsOf(t, dashboard, filtered)))
+
+	// the multi var is the set of the filtered values in the row
+	filtered[1].Multi = true
+	panels = renderPanelsOf(t, dashboard, filtered)
+	assert.Equal(t, "{news,payment} of eu", panels[3].Title)
+	assert.Equal(t, "user of us", panels[6].Title)
+	filtered[1].Multi = false
+
+	for _, filter := range []string{"{{.MISSING}}", "{{.REGION}}"} {
+		filtered[1].Filter = filter
+		_, err := RenderDashboard([]byte(dashboard), filtered)
+		assert.NotNil(t, err, filter)
+	}
+}
@@ -0,0 +1,249 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grafana-tools/sdk"
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+// Template is a template dashboard.
+type Template struct {
+	// UID is the UID of the template dashboard, the UIDs of the rendered dashboards are derived from it.
+	UID string
+	// Name is the file name without the extension, or the UID of the template in Grafana.
+	Name string
+	// Source tells where the template is loaded from, e.g. the file path.
+	Source    string
+	Dashboard []byte
+	// FolderID is the folder of the template dashboard in Grafana.
+	FolderID int
+	// URL is the path of the template dashboard in Grafana, it's empty if the template isn't in Grafana.
+	URL string
+}
+
+// TemplateSource loads the template dashboards.
+type TemplateSource interface {
+	Templates(ctx context.Context) ([]Template, error)
+}
+
+// apiTemplateSource loads the template dashboard from Grafana by UID.
+type apiTemplateSource struct {
+	client *sdk.Client
+	uid    string
+}
+
+// NewAPITemplateSource returns the source of the template dashboard in Grafana.
+func NewAPITemplateSource(client *sdk.Client, uid string) TemplateSource {
+	return &apiTemplateSource{client: client, uid: uid}
+}
+
+func (s *apiTemplateSource) Templates(ctx context.Context) ([]Template, error) {
+	dashboard, prop, err := s.client.GetRawDashboardByUID(ctx, s.uid)
+	if err != nil {
+		return nil, err
+	}
+	return []Template{{
+		UID:       s.uid,
+		Name:      s.uid,
+		Source:    "dashboard " + s.uid,
+		Dashboard: dashboard,
+		FolderID:  prop.FolderID,
+		URL:       "/d/" + s.uid,
+	}}, nil
+}
+
+// fileTemplateSource loads the template dashboards from a JSON file or the JSON files of a directory.
+type fileTemplateSource struct {
+	path string
+}
+
+// NewFileTemplateSource returns the source of the template dashboards in the JSON file,
+// or in the JSON files of the directory.
+func NewFileTemplateSource(path string) TemplateSource {
+	return &fileTemplateSource{path: path}
+}
+
+func (s *fileTemplateSource) Templates(ctx context.Context) ([]Template, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		tmpl, err := readTemplateFile(s.path)
+		if err != nil {
+			return nil, err
+		}
+		return []Template{tmpl}, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(s.path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no template dashboard in the directory %s", s.path)
+	}
+	sort.Strings(files)
+
+	templates := make([]Template, 0, len(files))
+	uids := make(map[string]string)
+	for _, file := range files {
+		tmpl, err := readTemplateFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := uids[tmpl.UID]; ok {
+			return nil, fmt.Errorf("the templates %s and %s have the same UID %q", other, file, tmpl.UID)
+		}
+		uids[tmpl.UID] = file
+		templates = append(templates, tmpl)
+	}
+	return templates, nil
+}
+
+// readTemplateFile reads the template dashboard from the JSON file, the template UID is the uid of the dashboard,
+// or the file name without the extension if the dashboard has none.
+func readTemplateFile(file string) (Template, error) {
+	dashboard, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Template{}, err
+	}
+	var meta struct {
+		UID string `json:"uid"`
+	}
+	if err := json.Unmarshal(dashboard, &meta); err != nil {
+		return Template{}, fmt.Errorf("fail to read the template %s: %w", file, err)
+	}
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	if meta.UID == "" {
+		meta.UID = name
+	}
+	return Template{UID: meta.UID, Name: name, Source: file, Dashboard: dashboard}, nil
+}
+
+// RenderedDashboard is the dashboard rendered from a template.
+type RenderedDashboard struct {
+	Template Template
+	// Name tells the dashboard from the others rendered together, it's made of the template name
+	// and the fan-out value.
+	Name      string
+	UID       string
+	Dashboard []byte
+}
+
+// RenderTemplates renders the dashboards of the templates from the source without saving them.
+func RenderTemplates(config UpdateConfig, source TemplateSource, vars RenderVars) ([]RenderedDashboard, error) {
+	templates, err := loadTemplates(context.Background(), config, source)
+	if err != nil {
+		return nil, err
+	}
+
+	var apiCli *apiClient
+	if config.APIUrl != "" {
+		if apiCli, err = newAPIClient(config); err != nil {
+			return nil, err
+		}
+	}
+	var rendered []RenderedDashboard
+	for _, tmpl := range templates {
+		targets, err := templateTargets(context.Background(), apiCli, config, tmpl, vars)
+		if err != nil {
+			return nil, err
+		}
+		for _, target := range targets {
+			r, err := renderTemplate(templateConfig(target.config, tmpl), tmpl, target.name, target.vars, 0)
+			if err != nil {
+				return nil, err
+			}
+			rendered = append(rendered, r)
+		}
+	}
+	return rendered, nil
+}
+
+// loadTemplates loads the templates from the source, the config can't render several templates
+// into one dashboard UID or one alert rule group.
+func loadTemplates(ctx context.Context, config UpdateConfig, source TemplateSource) ([]Template, error) {
+	templates, err := source.Templates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(templates) > 1 && config.RenderedUID != "" {
+		return nil, fmt.Errorf("the rendered UID %q can't be used by %d templates", config.RenderedUID, len(templates))
+	}
+	if len(templates) > 1 && config.FanOut.UID != "" {
+		return nil, fmt.Errorf("the fan-out UID %q can't be used by %d templates", config.FanOut.UID, len(templates))
+	}
+	if len(templates) > 1 && len(config.AlertRules.Rules) > 0 {
+		return nil, fmt.Errorf("the alert rules can't be rendered for %d templates", len(templates))
+	}
+	return templates, nil
+}
+
+// templateTargets returns the dashboards to render from the template, with the values of the query vars found.
+func templateTargets(ctx context.Context, cli *apiClient, config UpdateConfig, tmpl Template,
+	vars RenderVars) ([]renderTarget, error) {
+	// the defaults of the template are added first, so the fan-out var can be one of them
+	if dashboard, err := simplejson.NewJson(tmpl.Dashboard); err == nil {
+		vars = withTemplateDefaults(templateVariableList(dashboard), vars)
+		types, err := findDatasourceTypes(ctx, cli, dashboard, config.RenderOptions.Datasources)
+		if err != nil {
+			return nil, fmt.Errorf("fail to render %s: %w", tmpl.Source, err)
+		}
+		config.RenderOptions.Datasources = types
+	}
+	vars, err := resolveQueryVars(ctx, cli, tmpl.Dashboard, vars)
+	if err != nil {
+		return nil, fmt.Errorf("fail to render %s: %w", tmpl.Source, err)
+	}
+	targets, err := renderTargets(config, vars)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTargetTitles(tmpl, config.FanOut.Var, targets); err != nil {
+		return nil, fmt.Errorf("fail to render %s: %w", tmpl.Source, err)
+	}
+	return targets, nil
+}
+
+// templateConfig returns the config to render the template.
+func templateConfig(config UpdateConfig, tmpl Template) UpdateConfig {
+	config.DashboardUID = tmpl.UID
+	return config
+}
+
+// renderTemplate renders the template into the dashboard to be saved over the given version,
+// fanOutValue is the value of the fan-out var the dashboard is rendered for.
+func renderTemplate(config UpdateConfig, tmpl Template, fanOutValue string, vars RenderVars,
+	version int) (RenderedDashboard, error) {
+	rendered, err := RenderDashboardWithOptions(tmpl.Dashboard, vars, config.RenderOptions)
+	if err != nil {
+		return RenderedDashboard{}, fmt.Errorf("fail to render %s: %w", tmpl.Source, err)
+	}
+	uid := config.RenderedDashboardUID()
+	if err := checkRenderedUID(config, uid); err != nil {
+		return RenderedDashboard{}, err
+	}
+	rendered, err = withMetadata(rendered, config, tmpl, vars)
+	if err != nil {
+		return RenderedDashboard{}, fmt.Errorf("fail to render %s: %w", tmpl.Source, err)
+	}
+	rendered, err = prepareRendered(rendered, uid, version)
+	if err != nil {
+		return RenderedDashboard{}, err
+	}
+
+	name := tmpl.Name
+	if fanOutValue != "" {
+		name += "-" + fanOutValue
+	}
+	return RenderedDashboard{Template: tmpl, Name: name, UID: uid, Dashboard: rendered}, nil
+}
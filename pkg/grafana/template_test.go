@@ -0,0 +1,73 @@
+package grafana
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "grafops")
+	assert.Nil(t, err)
+	for name, content := range files {
+		assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestFileTemplateSource(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"svc.json":   `{"uid": "svc", "title": "$SERVICE_NAME"}`,
+		"infra.json": `{"title": "infra"}`,
+		"notes.txt":  `not a template`,
+	})
+	defer os.RemoveAll(dir)
+
+	templates, err := NewFileTemplateSource(dir).Templates(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, templates, 2)
+	// the template without uid is named after the file
+	assert.Equal(t, "infra", templates[0].UID)
+	assert.Equal(t, filepath.Join(dir, "infra.json"), templates[0].Source)
+	assert.Equal(t, "svc", templates[1].UID)
+
+	templates, err = NewFileTemplateSource(filepath.Join(dir, "svc.json")).Templates(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, templates, 1)
+	assert.Equal(t, "svc", templates[0].UID)
+
+	_, err = NewFileTemplateSource(filepath.Join(dir, "missing.json")).Templates(context.Background())
+	assert.NotNil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "copy.json"), []byte(`{"uid": "svc"}`), 0644))
+	_, err = NewFileTemplateSource(dir).Templates(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestRenderTemplates(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"svc.json":   `{"id": 2, "uid": "svc", "title": "$SERVICE_NAME **template**", "panels": []}`,
+		"infra.json": `{"title": "infra", "panels": []}`,
+	})
+	defer os.RemoveAll(dir)
+	vars := RenderVars{{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}}}}
+
+	rendered, err := RenderTemplates(UpdateConfig{Name: "prod"}, NewFileTemplateSource(dir), vars)
+	assert.Nil(t, err)
+	assert.Len(t, rendered, 2)
+
+	var dashboard map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rendered[1].Dashboard, &dashboard))
+	assert.Equal(t, "news ", dashboard["title"])
+	assert.Equal(t, UpdateConfig{DashboardUID: "svc", Name: "prod"}.RenderedDashboardUID(), rendered[1].UID)
+	assert.Equal(t, rendered[1].UID, dashboard["uid"])
+	assert.NotContains(t, dashboard, "id")
+
+	_, err = RenderTemplates(UpdateConfig{RenderedUID: "rendered"}, NewFileTemplateSource(dir), vars)
+	assert.NotNil(t, err)
+}
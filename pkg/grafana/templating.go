@@ -0,0 +1,264 @@
+package grafana
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+var (
+	// customOption is an option of the custom variable query, e.g. `news`, or `News : news` with the text.
+	customOption = regexp.MustCompile(`(?:\\,|[^,])+`)
+	customText   = regexp.MustCompile(`^\s*(.+)\s:\s(.+)$`)
+)
+
+// withTemplateDefaults returns the vars with the defaults of the custom, constant, interval and textbox variables
+// of the template which aren't in the vars, so a simple template can be rendered without vars.
+func withTemplateDefaults(templates []templateVariable, vars RenderVars) RenderVars {
+	var defaults RenderVars
+	for _, t := range templates {
+		if _, ok := vars.getVar(t.Name); ok {
+			continue
+		}
+		if v, ok := defaultVar(t); ok {
+			defaults = append(defaults, v)
+		}
+	}
+	if len(defaults) == 0 {
+		return vars
+	}
+	return append(append(RenderVars{}, vars...), defaults...)
+}
+
+// MissingTemplateVars returns the variables of the templates by the template source, which are neither in the vars
+// nor have the defaults in the template. The ad hoc filters and the datasource variables need no values.
+func MissingTemplateVars(source TemplateSource, vars RenderVars) (map[string][]string, error) {
+	templates, err := source.Templates(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	missing := make(map[string][]string)
+	for _, tmpl := range templates {
+		dashboard, err := simplejson.NewJson(tmpl.Dashboard)
+		if err != nil {
+			return nil, fmt.Errorf("fail to parse %s: %w", tmpl.Source, err)
+		}
+		list := templateVariableList(dashboard)
+		withDefaults := withTemplateDefaults(list, vars)
+		for _, t := range list {
+			if t.Type == "adhoc" || t.Type == "datasource" {
+				continue
+			}
+			if _, ok := withDefaults.getVar(t.Name); !ok {
+				missing[tmpl.Source] = append(missing[tmpl.Source], t.Name)
+			}
+		}
+	}
+	return missing, nil
+}
+
+// defaultVar returns the var with the values selected in the template variable, it's all the options if "All"
+// is selected, and it's multi if more than one option is selected.
+func defaultVar(t templateVariable) (Var, bool) {
+	var options []string
+	switch t.Type {
+	case "constant":
+		options = []string{fmt.Sprint(t.Query)}
+	case "textbox":
+		options = optionValues(t.Current.Value)
+		if len(options) == 0 || options[0] == "" {
+			options = []string{fmt.Sprint(t.Query)}
+		}
+	case "custom", "interval":
+		for _, o := range t.Options {
+			options = append(options, optionValues(o.Value)...)
+		}
+		if len(options) == 0 {
+			options = queryOptions(t)
+		}
+	default:
+		return Var{}, false
+	}
+	options = withoutSpecialValues(options)
+	if len(options) == 0 {
+		return Var{}, false
+	}
+
+	values := options
+	all := false
+	if t.Type == "custom" || t.Type == "interval" {
+		selected := withoutSpecialValues(optionValues(t.Current.Value))
+		all = containsString(optionValues(t.Current.Value), allValue)
+		switch {
+		case all:
+		case len(selected) > 0:
+			values = selected
+		default:
+			values = options[:1]
+		}
+	}
+
+	v := Var{Name: t.Name, Multi: all || len(values) > 1}
+	for _, value := range values {
+		v.Values = append(v.Values, Val{Value: value})
+	}
+	return v, true
+}
+
+// queryOptions returns the options in the query of the custom or interval variable, e.g. `1m,10m,1h`.
+func queryOptions(t templateVariable) []string {
+	query, _ := t.Query.(string)
+	if t.Type == "interval" {
+		var options []string
+		for _, o := range strings.Split(query, ",") {
+			options = append(options, strings.TrimSpace(o))
+		}
+		return options
+	}
+
+	var options []string
+	for _, o := range customOption.FindAllString(query, -1) {
+		if m := customText.FindStringSubmatch(o); m != nil {
+			options = append(options, strings.TrimSpace(m[2]))
+			continue
+		}
+		options = append(options, strings.ReplaceAll(strings.TrimSpace(o), `\,`, ","))
+	}
+	return options
+}
+
+// optionValues returns the values of the option value, which is a string or a list of strings.
+func optionValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// withoutSpecialValues returns the values except the "All" option and the auto interval.
+func withoutSpecialValues(values []string) []string {
+	var filtered []string
+	for _, v := range values {
+		if v != allValue && !strings.HasPrefix(v, "$__auto_interval") {
+			filtered = append(filtered, v)
+		}
+	}
+	return filtered
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// The ways to process the rendered variables in the templating section of the rendered dashboard.
+const (
+	// TemplatingKeep keeps the variables as they are in the template.
+	TemplatingKeep = "keep"
+	// TemplatingRemove removes the variables.
+	TemplatingRemove = "remove"
+	// TemplatingHide keeps the variables but hides them.
+	TemplatingHide = "hide"
+	// TemplatingPin selects the rendered values in the variables.
+	TemplatingPin = "pin"
+)
+
+// hideVariable is the hide option of the variable hiding both the label and the dropdown.
+const hideVariable = 2
+
+// processTemplating processes the variables of the rendered dashboard which are rendered by the vars,
+// the ad hoc filters and the variables without values are left alone.
+func (r *renderer) processTemplating(dashboard map[string]interface{}) error {
+	switch r.options.Templating {
+	case "", TemplatingKeep:
+		return nil
+	case TemplatingRemove, TemplatingHide, TemplatingPin:
+	default:
+		return fmt.Errorf("unknown templating option %q, it should be one of %s, %s, %s or %s",
+			r.options.Templating, TemplatingKeep, TemplatingRemove, TemplatingHide, TemplatingPin)
+	}
+
+	templating, _ := dashboard["templating"].(map[string]interface{})
+	list, _ := templating["list"].([]interface{})
+	if len(list) == 0 {
+		return nil
+	}
+
+	processed := make([]interface{}, 0, len(list))
+	for _, e := range list {
+		variable, ok := e.(map[string]interface{})
+		if !ok || variable["type"] == "adhoc" {
+			processed = append(processed, e)
+			continue
+		}
+		name, _ := variable["name"].(string)
+		v, ok := r.vars.getVar(name)
+		if !ok || len(v.Values) == 0 {
+			processed = append(processed, e)
+			continue
+		}
+
+		switch r.options.Templating {
+		case TemplatingRemove:
+			continue
+		case TemplatingHide:
+			variable["hide"] = hideVariable
+		case TemplatingPin:
+			pinVariable(variable, v)
+		}
+		processed = append(processed, variable)
+	}
+	templating["list"] = processed
+	return nil
+}
+
+// pinVariable selects the values the var is rendered with outside the repeated panels in the variable.
+func pinVariable(variable map[string]interface{}, v Var) {
+	var values []string
+	switch val := v.Values[0]; {
+	case v.Multi || val.Value == allValue:
+		values = v.allValues()
+		if includeAll, _ := variable["includeAll"].(bool); includeAll {
+			values = []string{allValue}
+		}
+	case len(val.Values) > 0:
+		values = val.Values
+	default:
+		values = []string{val.Value}
+	}
+
+	text := strings.Join(values, " + ")
+	if len(values) == 1 && values[0] == allValue {
+		text = "All"
+	}
+	var value interface{} = values
+	if multi, _ := variable["multi"].(bool); !multi && len(values) == 1 {
+		value = values[0]
+	}
+	variable["current"] = map[string]interface{}{"selected": true, "text": text, "value": value}
+
+	if options, ok := variable["options"].([]interface{}); ok {
+		for _, o := range options {
+			if option, ok := o.(map[string]interface{}); ok {
+				value, _ := option["value"].(string)
+				option["selected"] = containsString(values, value)
+			}
+		}
+	}
+}
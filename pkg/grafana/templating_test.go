@@ -0,0 +1,137 @@
+package grafana
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+const defaultsTemplate = `{"uid": "svc", "title": "services", "templating": {"list": [
+  {"name": "SERVICE_NAME", "type": "custom", "query": "News : news,payment,a\\,b", "multi": true, "includeAll": true,
+   "current": {"text": "All", "value": ["$__all"]}},
+  {"name": "ENV", "type": "custom", "query": "prod,staging",
+   "options": [{"text": "prod", "value": "prod"}, {"text": "staging", "value": "staging"}],
+   "current": {"text": "staging", "value": "staging"}},
+  {"name": "REGION", "type": "constant", "query": "eu"},
+  {"name": "FILTER", "type": "textbox", "query": "up", "current": {"value": ""}},
+  {"name": "INTERVAL", "type": "interval", "query": "1m,10m", "auto": true,
+   "options": [{"value": "$__auto_interval_INTERVAL"}, {"value": "1m"}, {"value": "10m"}], "current": {"value": "10m"}},
+  {"name": "JOB", "type": "query", "query": "label_values(job)"}
+]}, "panels": [
+  {"type": "row", "id": 1, "title": "$SERVICE_NAME", "repeat": "SERVICE_NAME", "gridPos": {"h": 1, "w": 24, "x": 0, "y": 0}},
+  {"type": "graph", "id": 2, "title": "$SERVICE_NAME in $ENV/$REGION $FILTER $INTERVAL",
+   "gridPos": {"h": 8, "w": 24, "x": 0, "y": 1}}
+]}`
+
+func TestWithTemplateDefaults(t *testing.T) {
+	dashboard, err := simplejson.NewJson([]byte(defaultsTemplate))
+	assert.Nil(t, err)
+
+	vars := withTemplateDefaults(templateVariableList(dashboard), RenderVars{
+		{Name: "ENV", Values: []Val{{Value: "prod"}}},
+	})
+	assert.Equal(t, RenderVars{
+		// the configured vars take precedence over the template
+		{Name: "ENV", Values: []Val{{Value: "prod"}}},
+		// "All" is selected
+		{Name: "SERVICE_NAME", Multi: true, Values: []Val{{Value: "news"}, {Value: "payment"}, {Value: "a,b"}}},
+		{Name: "REGION", Values: []Val{{Value: "eu"}}},
+		{Name: "FILTER", Values: []Val{{Value: "up"}}},
+		{Name: "INTERVAL", Values: []Val{{Value: "10m"}}},
+	}, vars)
+}
+
+func TestRenderDashboardWithTemplateDefaults(t *testing.T) {
+	rendered, err := RenderDashboard([]byte(defaultsTemplate), nil)
+	assert.Nil(t, err)
+
+	var dashboard map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rendered, &dashboard))
+	panels := dashboard["panels"].([]interface{})
+	assert.Len(t, panels, 6)
+	assert.Equal(t, "news in staging/eu up 10m", panels[1].(map[string]interface{})["title"])
+	assert.Equal(t, "a,b in staging/eu up 10m", panels[5].(map[string]interface{})["title"])
+}
+
+func TestMissingTemplateVars(t *testing.T) {
+	simple := `{"uid": "simple", "templating": {"list": [{"name": "ENV", "type": "custom", "query": "prod"},
+  {"name": "Filters", "type": "adhoc"}, {"name": "ds", "type": "datasource", "query": "prometheus"}]}, "panels": []}`
+	dir := writeTemplates(t, map[string]string{"svc.json": defaultsTemplate, "simple.json": simple})
+	defer os.RemoveAll(dir)
+
+	// the query variables have no defaults, but the ad hoc filters and the datasource variables need none
+	missing, err := MissingTemplateVars(NewFileTemplateSource(dir), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{filepath.Join(dir, "svc.json"): {"JOB"}}, missing)
+
+	missing, err = MissingTemplateVars(NewFileTemplateSource(dir), RenderVars{{Name: "JOB", Query: true}})
+	assert.Nil(t, err)
+	assert.Empty(t, missing)
+}
+
+const templatingTemplate = `{"uid": "svc", "title": "services", "templating": {"list": [
+  {"name": "SERVICE_NAME", "type": "custom", "query": "news,payment", "multi": true, "includeAll": true,
+   "options": [{"text": "news", "value": "news", "selected": false}, {"text": "payment", "value": "payment", "selected": true}],
+   "current": {"text": "payment", "value": ["payment"]}},
+  {"name": "ENV", "type": "custom", "query": "prod,staging", "current": {"text": "prod", "value": "prod"}},
+  {"name": "JOB", "type": "query", "query": "label_values(job)"},
+  {"name": "Filters", "type": "adhoc"}
+]}, "panels": []}`
+
+func TestRenderDashboardTemplating(t *testing.T) {
+	vars := RenderVars{
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}}},
+		{Name: "ENV", Multi: true, Values: []Val{{Value: "prod"}, {Value: "staging"}}},
+	}
+	tests := []struct {
+		templating string
+		expected   []string
+	}{
+		{"", []string{
+			`{"current":{"text":"payment","value":["payment"]},"includeAll":true,"multi":true,"name":"SERVICE_NAME","options":[{"selected":false,"text":"news","value":"news"},{"selected":true,"text":"payment","value":"payment"}],"query":"news,payment","type":"custom"}`,
+			`{"current":{"text":"prod","value":"prod"},"name":"ENV","query":"prod,staging","type":"custom"}`,
+			`{"name":"JOB","query":"label_values(job)","type":"query"}`,
+			`{"name":"Filters","type":"adhoc"}`,
+		}},
+		{TemplatingRemove, []string{
+			`{"name":"JOB","query":"label_values(job)","type":"query"}`,
+			`{"name":"Filters","type":"adhoc"}`,
+		}},
+		{TemplatingHide, []string{
+			`{"current":{"text":"payment","value":["payment"]},"hide":2,"includeAll":true,"multi":true,"name":"SERVICE_NAME","options":[{"selected":false,"text":"news","value":"news"},{"selected":true,"text":"payment","value":"payment"}],"query":"news,payment","type":"custom"}`,
+			`{"current":{"text":"prod","value":"prod"},"hide":2,"name":"ENV","query":"prod,staging","type":"custom"}`,
+			`{"name":"JOB","query":"label_values(job)","type":"query"}`,
+			`{"name":"Filters","type":"adhoc"}`,
+		}},
+		{TemplatingPin, []string{
+			`{"current":{"selected":true,"text":"news","value":["news"]},"includeAll":true,"multi":true,"name":"SERVICE_NAME","options":[{"selected":true,"text":"news","value":"news"},{"selected":false,"text":"payment","value":"payment"}],"query":"news,payment","type":"custom"}`,
+			`{"current":{"selected":true,"text":"prod + staging","value":["prod","staging"]},"name":"ENV","query":"prod,staging","type":"custom"}`,
+			`{"name":"JOB","query":"label_values(job)","type":"query"}`,
+			`{"name":"Filters","type":"adhoc"}`,
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.templating, func(t *testing.T) {
+			rendered, err := RenderDashboardWithOptions([]byte(templatingTemplate), vars, RenderOptions{Templating: test.templating})
+			assert.Nil(t, err)
+
+			dashboard, err := simplejson.NewJson(rendered)
+			assert.Nil(t, err)
+			list, err := dashboard.GetPath("templating", "list").Array()
+			assert.Nil(t, err)
+			var actual []string
+			for _, v := range list {
+				b, _ := json.Marshal(v)
+				actual = append(actual, string(b))
+			}
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+
+	_, err := RenderDashboardWithOptions([]byte(templatingTemplate), vars, RenderOptions{Templating: "drop"})
+	assert.NotNil(t, err)
+}
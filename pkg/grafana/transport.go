@@ -0,0 +1,100 @@
+package grafana
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// HTTPConfig is how grafops connects to Grafana.
+type HTTPConfig struct {
+	// CAFile is the PEM bundle of the CAs verifying the certificate of Grafana, besides the system CAs.
+	CAFile string `json:"caFile"`
+	// CertFile and KeyFile are the PEM client certificate and key for mTLS.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	// InsecureSkipVerify skips verifying the certificate of Grafana.
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+	// ProxyURL is the HTTP proxy to Grafana, it defaults to the proxy of the environment variables.
+	ProxyURL string `json:"proxyURL"`
+	// Timeout is the time limit of a request to Grafana, zero means no limit.
+	Timeout time.Duration `json:"timeout"`
+	// Headers are added to every request, e.g. the user header of an auth proxy.
+	Headers map[string]string `json:"headers"`
+}
+
+// newHTTPClient returns the HTTP client to Grafana with the HTTP config and the credentials in the config.
+func newHTTPClient(config UpdateConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	tlsConfig, err := config.HTTP.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	if config.HTTP.ProxyURL != "" {
+		proxyURL, err := url.Parse(config.HTTP.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	var base http.RoundTripper = transport
+	if len(config.HTTP.Headers) > 0 {
+		base = &headerTransport{headers: config.HTTP.Headers, base: base}
+	}
+	return &http.Client{
+		Timeout:   config.HTTP.Timeout,
+		Transport: &authTransport{header: config.authHeader(), base: base},
+	}, nil
+}
+
+// tlsConfig returns the TLS config with the CAs and the client certificate.
+func (c HTTPConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to read the CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in the CA file %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, errors.New("both the client certificate and key are needed")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail to load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// headerTransport adds the headers to the requests.
+type headerTransport struct {
+	headers map[string]string
+	base    http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,132 @@
+package grafana
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeClientCert writes a self-signed client certificate and its key, and returns the certificate.
+func writeClientCert(t *testing.T, dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "grafops"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "client.crt"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "client.key"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert
+}
+
+func TestHTTPConfigTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grafops")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	clientCert := writeClientCert(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-WEBAUTH-USER") != "admin" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	// the failed handshakes are expected
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.Nil(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	headers := map[string]string{"X-WEBAUTH-USER": "admin"}
+
+	tests := []struct {
+		name string
+		http HTTPConfig
+		ok   bool
+	}{
+		{"unknown CA", HTTPConfig{CertFile: certFile, KeyFile: keyFile, Headers: headers}, false},
+		{"no client certificate", HTTPConfig{CAFile: caFile, Headers: headers}, false},
+		{"mTLS", HTTPConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, Headers: headers}, true},
+		{"insecure", HTTPConfig{InsecureSkipVerify: true, CertFile: certFile, KeyFile: keyFile, Headers: headers}, true},
+		{"no headers", HTTPConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cli, err := newAPIClient(UpdateConfig{APIUrl: server.URL, HTTP: test.http})
+			assert.Nil(t, err)
+			err = cli.do(context.Background(), http.MethodGet, "/api/health", nil, nil)
+			assert.Equal(t, test.ok, err == nil, "%v", err)
+		})
+	}
+
+	for _, config := range []HTTPConfig{
+		{CAFile: filepath.Join(dir, "missing.crt")},
+		{CAFile: keyFile},
+		{CertFile: certFile},
+		{ProxyURL: "://proxy"},
+	} {
+		_, err := newAPIClient(UpdateConfig{APIUrl: server.URL, HTTP: config})
+		assert.NotNil(t, err, "%+v", config)
+	}
+}
+
+func TestHTTPConfigProxyAndTimeout(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		proxied = append(proxied, req.URL.String())
+		if req.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer proxy.Close()
+
+	config := UpdateConfig{APIUrl: "http://grafana.internal", HTTP: HTTPConfig{
+		ProxyURL: proxy.URL,
+		Timeout:  50 * time.Millisecond,
+	}}
+	cli, err := newAPIClient(config)
+	assert.Nil(t, err)
+	assert.Nil(t, cli.do(context.Background(), http.MethodGet, "/api/health", nil, nil))
+	assert.Equal(t, []string{"http://grafana.internal/api/health"}, proxied)
+
+	assert.NotNil(t, cli.do(context.Background(), http.MethodGet, "/slow", nil, nil))
+}
@@ -0,0 +1,28 @@
+package grafana
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+)
+
+// maxUIDLength is the max length of the UIDs in Grafana.
+const maxUIDLength = 40
+
+// derivedUID returns the UID made of the base UID and the hash of the keys, it's truncated to fit in the UID length.
+func derivedUID(base string, keys ...string) string {
+	suffix := "-" + hashUID(append([]string{base}, keys...)...)[:12]
+	if len(base)+len(suffix) > maxUIDLength {
+		base = base[:maxUIDLength-len(suffix)]
+	}
+	return base + suffix
+}
+
+// hashUID returns a UID hashed from the keys.
+func hashUID(keys ...string) string {
+	h := sha1.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:maxUIDLength]
+}
@@ -0,0 +1,359 @@
+package grafana
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+)
+
+// allValue is the value Grafana uses for the "All" option of a variable.
+const allValue = "$__all"
+
+// variable is a variable resolved for rendering.
+type variable struct {
+	values []string
+	// multi is true if the variable is rendered as a set of values.
+	multi bool
+	// customAll is true if the value is the custom all value, which is never formatted.
+	customAll bool
+	// templateMulti is true if the template variable is multi-value or includes "All",
+	// datasources format the variable as a set by default in this case.
+	templateMulti bool
+}
+
+// format formats the variable with the format option, the datasource decides the default format.
+func (v variable) format(name string, format string, datasource string) string {
+	if v.customAll && format != "text" && format != "queryparam" {
+		return strings.Join(v.values, ",")
+	}
+	if format == "" {
+		return defaultFormatter(datasource, v.multi || v.templateMulti)(name, v.values, v.multi)
+	}
+	return formatValue(name, v.values, v.multi, format)
+}
+
+// templateVariable is the variable defined in the templating section of the dashboard.
+type templateVariable struct {
+	Name       string `json:"name"`
+	Multi      bool   `json:"multi"`
+	IncludeAll bool   `json:"includeAll"`
+	AllValue   string `json:"allValue"`
+	// Type, Datasource, Query, Regex and Sort tell how the values of the query variable are found.
+	Type       string      `json:"type"`
+	Datasource interface{} `json:"datasource"`
+	Query      interface{} `json:"query"`
+	Regex      string      `json:"regex"`
+	Sort       int         `json:"sort"`
+	// Options and Current are the options and the selected option of the variable.
+	Options []templateOption `json:"options"`
+	Current templateOption   `json:"current"`
+}
+
+// templateOption is an option of the template variable, the value is a string or a list of strings.
+type templateOption struct {
+	Text  interface{} `json:"text"`
+	Value interface{} `json:"value"`
+}
+
+// templateVariableList returns the variables defined in the templating section of the dashboard.
+func templateVariableList(dashboard *simplejson.Json) []templateVariable {
+	var list []templateVariable
+	listBytes, _ := dashboard.GetPath("templating", "list").Encode()
+	_ = json.Unmarshal(listBytes, &list)
+	return list
+}
+
+// templateVariables returns the variables defined in the templating section of the dashboard by name.
+func templateVariables(dashboard *simplejson.Json) map[string]templateVariable {
+	list := templateVariableList(dashboard)
+	templates := make(map[string]templateVariable, len(list))
+	for _, t := range list {
+		templates[t.Name] = t
+	}
+	return templates
+}
+
+// renderer renders a dashboard with the variables.
+type renderer struct {
+	vars      RenderVars
+	options   RenderOptions
+	templates map[string]templateVariable
+	// datasources are the plugin types of the datasource references.
+	datasources map[string]string
+	// copies are the rendered panels with the template panels they are copied from.
+	copies []panelCopy
+}
+
+// panelCopy is a panel rendered from the template panel with the variables in scope.
+type panelCopy struct {
+	templateID int
+	scope      renderScope
+	panel      map[string]interface{}
+}
+
+func newRenderer(dashboard *simplejson.Json, vars RenderVars, options RenderOptions) *renderer {
+	return &renderer{
+		vars:        withTemplateDefaults(templateVariableList(dashboard), vars),
+		options:     options,
+		templates:   templateVariables(dashboard),
+		datasources: datasourceTypes(dashboard, options.Datasources),
+	}
+}
+
+// resolve returns the variable the val of var stands for.
+func (r *renderer) resolve(v Var, val Val) variable {
+	tmpl := r.templates[v.Name]
+	res := variable{templateMulti: tmpl.Multi || tmpl.IncludeAll}
+	switch {
+	case val.Value == allValue:
+		custom := v.AllValue
+		if custom == "" {
+			custom = tmpl.AllValue
+		}
+		if custom != "" {
+			res.values = []string{custom}
+			res.customAll = true
+		} else {
+			res.values = v.allValues()
+			res.multi = true
+		}
+	case len(val.Values) > 0:
+		res.values = val.Values
+		res.multi = true
+	default:
+		res.values = []string{val.Value}
+	}
+	return res
+}
+
+// single returns the variable with a single value, e.g. the value in the context of a val.
+func (r *renderer) single(name string, value string) variable {
+	tmpl := r.templates[name]
+	return variable{
+		values:        []string{value},
+		templateMulti: tmpl.Multi || tmpl.IncludeAll,
+	}
+}
+
+// renderScope is the variables used to render a part of the dashboard.
+type renderScope struct {
+	vars map[string]variable
+	// repeats are the names of the variables the part is repeated by, from the outermost one.
+	repeats []string
+	// nested are the vars of the repeated values, they override the vars the inner parts are repeated by.
+	nested map[string]Var
+}
+
+// globalScope returns the variables used outside the repeated panels, the multi var is the set of
+// all its values, otherwise the first value is picked.
+func (r *renderer) globalScope() renderScope {
+	vars := make(map[string]variable)
+	for _, v := range r.vars {
+		if len(v.Values) == 0 {
+			continue
+		}
+		if v.Multi {
+			vars[v.Name] = r.resolve(v, Val{Value: allValue})
+		} else {
+			vars[v.Name] = r.resolve(v, v.Values[0])
+		}
+	}
+	return renderScope{vars: vars}
+}
+
+// repeatScope returns the variables used in the panels repeated for the val of var, the vars and
+// the context of the val override the variables of the parent scope, and the vars with filters
+// are narrowed to the values passing the filters in the scope.
+func (r *renderer) repeatScope(parent renderScope, v Var, val Val) (renderScope, error) {
+	vars := make(map[string]variable, len(parent.vars))
+	for k, pv := range parent.vars {
+		vars[k] = pv
+	}
+	nested := parent.nested
+	if len(val.Vars) > 0 {
+		nested = make(map[string]Var, len(parent.nested)+len(val.Vars))
+		for k, nv := range parent.nested {
+			nested[k] = nv
+		}
+		for _, nv := range val.Vars {
+			nested[nv.Name] = nv
+			if len(nv.Values) == 0 {
+				continue
+			}
+			// like the global scope, outside the panels repeated by the nested var
+			if nv.Multi {
+				vars[nv.Name] = r.resolve(nv, Val{Value: allValue})
+			} else {
+				vars[nv.Name] = r.resolve(nv, nv.Values[0])
+			}
+		}
+	}
+	for k, cv := range val.Context {
+		vars[k] = r.single(k, cv)
+	}
+	vars[v.Name] = r.resolve(v, val)
+
+	repeats := append(append([]string{}, parent.repeats...), v.Name)
+	scope := renderScope{vars: vars, repeats: repeats, nested: nested}
+	if err := r.filterScope(scope, val.Context); err != nil {
+		return renderScope{}, err
+	}
+	return scope, nil
+}
+
+// filterScope narrows the vars with filters in the scope to the values passing the filters, like the global
+// scope the multi var is the set of the values, otherwise the first value is picked. The repeat vars and the
+// vars in the context are left alone, and a var without any values passing is removed from the scope.
+func (r *renderer) filterScope(scope renderScope, context map[string]string) error {
+	vars := append(RenderVars{}, r.vars...)
+	for _, nv := range scope.nested {
+		if _, ok := vars.getVar(nv.Name); !ok {
+			vars = append(vars, nv)
+		}
+	}
+	for _, v := range vars {
+		if nv, ok := scope.nested[v.Name]; ok {
+			v = nv
+		}
+		if _, ok := context[v.Name]; ok || v.Filter == "" || containsString(scope.repeats, v.Name) {
+			continue
+		}
+		filtered, err := filterVar(v, scope)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(filtered.Values) == 0:
+			delete(scope.vars, v.Name)
+		case v.Multi:
+			scope.vars[v.Name] = r.resolve(filtered, Val{Value: allValue})
+		default:
+			scope.vars[v.Name] = r.resolve(filtered, filtered.Values[0])
+		}
+	}
+	return nil
+}
+
+// variableRef is a reference to a template variable found in a text, it could be
+// one of the Grafana syntaxes: `$var`, `${var}`, `${var:format}` or `[[var]]`.
+type variableRef struct {
+	// start and end are the byte offsets of the whole reference in the text.
+	start, end int
+	name       string
+	fieldPath  string
+	format     string
+}
+
+// scanVariables returns the variable references in text in order of appearance.
+// A name always spans the whole identifier, so `$SERVICE` never matches the prefix of
+// `$SERVICE_NAME`, the longest name wins regardless of which variables are defined.
+func scanVariables(text string) []variableRef {
+	var refs []variableRef
+	for i := 0; i < len(text); {
+		ref, ok := scanVariable(text, i)
+		if !ok {
+			i++
+			continue
+		}
+		refs = append(refs, ref)
+		i = ref.end
+	}
+	return refs
+}
+
+// scanVariable tries to read a variable reference starting at offset i of text.
+func scanVariable(text string, i int) (variableRef, bool) {
+	ref := variableRef{start: i}
+	switch {
+	case strings.HasPrefix(text[i:], "${"):
+		// ${var}, ${var.fieldPath}, ${var:format}
+		pos := i + 2
+		ref.name, pos = scanIdentifier(text, pos)
+		if ref.name == "" {
+			return ref, false
+		}
+		if pos < len(text) && text[pos] == '.' {
+			end := strings.IndexAny(text[pos+1:], ":}")
+			if end <= 0 {
+				return ref, false
+			}
+			ref.fieldPath = text[pos+1 : pos+1+end]
+			pos += 1 + end
+		}
+		if pos < len(text) && text[pos] == ':' {
+			end := strings.IndexByte(text[pos+1:], '}')
+			if end <= 0 {
+				return ref, false
+			}
+			ref.format = text[pos+1 : pos+1+end]
+			pos += 1 + end
+		}
+		if pos >= len(text) || text[pos] != '}' {
+			return ref, false
+		}
+		ref.end = pos + 1
+		return ref, true
+	case text[i] == '$':
+		// $var
+		ref.name, ref.end = scanIdentifier(text, i+1)
+		return ref, ref.name != ""
+	case strings.HasPrefix(text[i:], "[["):
+		// [[var]], [[var:format]]
+		pos := i + 2
+		ref.name, pos = scanIdentifier(text, pos)
+		if ref.name == "" {
+			return ref, false
+		}
+		if pos < len(text) && text[pos] == ':' {
+			ref.format, pos = scanIdentifier(text, pos+1)
+			if ref.format == "" {
+				return ref, false
+			}
+		}
+		if !strings.HasPrefix(text[pos:], "]]") {
+			return ref, false
+		}
+		ref.end = pos + 2
+		return ref, true
+	}
+	return ref, false
+}
+
+// scanIdentifier reads the longest identifier starting at offset i of text, and returns
+// it with the offset right after it.
+func scanIdentifier(text string, i int) (string, int) {
+	end := i
+	for end < len(text) && isIdentifierChar(text[end]) {
+		end++
+	}
+	return text[i:end], end
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// interpolate replaces the variable references in text with the variables in scope formatted by the
+// format options in a single pass, references to unknown variables are kept as they are and
+// the values are never re-scanned. datasource is the type of the datasource the text is sent to.
+func interpolate(text string, scope map[string]variable, datasource string) string {
+	refs := scanVariables(text)
+	if len(refs) == 0 {
+		return text
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, ref := range refs {
+		v, ok := scope[ref.name]
+		if !ok || ref.fieldPath != "" {
+			continue
+		}
+		sb.WriteString(text[last:ref.start])
+		sb.WriteString(v.format(ref.name, ref.format, datasource))
+		last = ref.end
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
+}
@@ -0,0 +1,220 @@
+package grafana
+
+import (
+	"testing"
+
+	"github.com/songrgg/grafops/pkg/simplejson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanVariables(t *testing.T) {
+	tests := []struct {
+		text string
+		refs []variableRef
+	}{
+		{"no variables", nil},
+		{"$SERVICE_NAME", []variableRef{{start: 0, end: 13, name: "SERVICE_NAME"}}},
+		{"a ${SERVICE}_NAME", []variableRef{{start: 2, end: 12, name: "SERVICE"}}},
+		{"[[SERVICE_NAME]]", []variableRef{{start: 0, end: 16, name: "SERVICE_NAME"}}},
+		{"[[SERVICE_NAME:regex]]", []variableRef{{start: 0, end: 22, name: "SERVICE_NAME", format: "regex"}}},
+		{"${SERVICE_NAME:regex}", []variableRef{{start: 0, end: 21, name: "SERVICE_NAME", format: "regex"}}},
+		{"${obj.a.b:json}", []variableRef{{start: 0, end: 15, name: "obj", fieldPath: "a.b", format: "json"}}},
+		{"$A$B", []variableRef{{start: 0, end: 2, name: "A"}, {start: 2, end: 4, name: "B"}}},
+		{"price $ and ${ and [[ and ${} and [[x", nil},
+		{"${unclosed", nil},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.refs, scanVariables(tt.text), tt.text)
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	scope := singleScope(map[string]string{
+		"SERVICE":      "svc",
+		"SERVICE_NAME": "news",
+		"S":            "s",
+		"REF":          "$SERVICE",
+	})
+
+	tests := []struct {
+		text     string
+		expected string
+	}{
+		{"$SERVICE_NAME", "news"},
+		{"$SERVICE", "svc"},
+		{"$S", "s"},
+		{"$SERVICE_NAME $SERVICE $S", "news svc s"},
+		{"$SERVICE_NAMES", "$SERVICE_NAMES"},
+		{"${SERVICE}_NAME", "svc_NAME"},
+		{"${SERVICE_NAME}", "news"},
+		{"[[SERVICE_NAME]]", "news"},
+		{"[[SERVICE]]_NAME", "svc_NAME"},
+		{"${SERVICE_NAME:raw}", "news"},
+		{"$SERVICE_NAME$SERVICE", "newssvc"},
+		{"rate(x{service=\"$SERVICE_NAME\"}[$__interval])", "rate(x{service=\"news\"}[$__interval])"},
+		{"$timeFilter and $UNKNOWN", "$timeFilter and $UNKNOWN"},
+		{"$REF", "$SERVICE"},
+		{"costs 5$", "costs 5$"},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, interpolate(tt.text, scope, ""), tt.text)
+	}
+}
+
+func TestRenderDashboardOverlappingNames(t *testing.T) {
+	vars := RenderVars{
+		{Name: "SERVICE", Values: []Val{{Value: "svc"}}},
+		{Name: "SERVICE_NAME", Values: []Val{{Value: "news"}}},
+		{Name: "SERVICE_NAME_SUFFIX", Values: []Val{{Value: "v1"}}},
+	}
+	dashboard := `{"panels":[{"title":"$SERVICE $SERVICE_NAME"}],"title":"$SERVICE_NAME_SUFFIX $SERVICE_NAME $SERVICE"}`
+
+	for i := 0; i < 20; i++ {
+		rendered, err := RenderDashboard([]byte(dashboard), vars)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"panels":[{"id":1,"title":"svc news"}],"title":"v1 news svc"}`, string(rendered))
+	}
+}
+
+// singleScope returns the scope of single-valued variables.
+func singleScope(ctx map[string]string) map[string]variable {
+	scope := make(map[string]variable, len(ctx))
+	for k, v := range ctx {
+		scope[k] = variable{values: []string{v}}
+	}
+	return scope
+}
+
+const multiValueDashboard = `{
+  "panels": [
+    {"type": "graph", "title": "$SERVICE_NAME", "gridPos": {"h": 8, "w": 12, "x": 0, "y": 0},
+     "datasource": {"type": "prometheus", "uid": "prom"},
+     "targets": [{"expr": "up{service=~\"$SERVICE_NAME\", env=\"$ENV\"}", "refId": "A"}]},
+    {"type": "graph", "title": "$SERVICE_NAME", "gridPos": {"h": 8, "w": 12, "x": 12, "y": 0},
+     "datasource": {"type": "graphite", "uid": "graphite"},
+     "targets": [{"target": "$SERVICE_NAME.requests", "refId": "A"},
+                 {"target": "$SERVICE_NAME.errors", "refId": "B", "datasource": {"type": "influxdb"}}]}
+  ],
+  "templating": {"list": [
+    {"name": "SERVICE_NAME", "multi": true, "includeAll": true, "allValue": null},
+    {"name": "ENV", "multi": false, "includeAll": true, "allValue": ".+"}
+  ]}
+}`
+
+func renderMultiValue(t *testing.T, vars RenderVars) []string {
+	rendered, err := RenderDashboard([]byte(multiValueDashboard), vars)
+	assert.Nil(t, err)
+
+	j, err := simplejson.NewJson(rendered)
+	assert.Nil(t, err)
+	return []string{
+		j.Get("panels").GetIndex(0).Get("title").MustString(),
+		j.Get("panels").GetIndex(0).Get("targets").GetIndex(0).Get("expr").MustString(),
+		j.Get("panels").GetIndex(1).Get("targets").GetIndex(0).Get("target").MustString(),
+		j.Get("panels").GetIndex(1).Get("targets").GetIndex(1).Get("target").MustString(),
+	}
+}
+
+func TestRenderDashboardMultiValue(t *testing.T) {
+	tests := []struct {
+		name     string
+		vars     RenderVars
+		expected []string
+	}{
+		{
+			name: "multi var renders all the values",
+			vars: RenderVars{
+				{Name: "SERVICE_NAME", Multi: true, Values: []Val{{Value: "news"}, {Value: "pay.ment"}}},
+				{Name: "ENV", Values: []Val{{Value: "prod"}}},
+			},
+			expected: []string{
+				"{news,pay.ment}",
+				`up{service=~"(news|pay\\.ment)", env="prod"}`,
+				"{news,pay.ment}.requests",
+				`(news|pay\.ment).errors`,
+			},
+		},
+		{
+			name: "single value of a multi template variable",
+			vars: RenderVars{
+				{Name: "SERVICE_NAME", Values: []Val{{Value: "pay.ment"}, {Value: "news"}}},
+			},
+			expected: []string{
+				"pay.ment",
+				`up{service=~"pay\\.ment", env="$ENV"}`,
+				"pay.ment.requests",
+				`pay\.ment.errors`,
+			},
+		},
+		{
+			name: "val with a set of values",
+			vars: RenderVars{
+				{Name: "SERVICE_NAME", Values: []Val{{Values: []string{"news", "user"}}}},
+			},
+			expected: []string{
+				"{news,user}",
+				`up{service=~"(news|user)", env="$ENV"}`,
+				"{news,user}.requests",
+				`(news|user).errors`,
+			},
+		},
+		{
+			name: "all option without custom all value",
+			vars: RenderVars{
+				{Name: "SERVICE_NAME", Values: []Val{{Value: "$__all"}, {Value: "news"}, {Value: "user"}}},
+				{Name: "ENV", AllValue: ".*", Values: []Val{{Value: "$__all"}, {Value: "prod"}}},
+			},
+			expected: []string{
+				"{news,user}",
+				`up{service=~"(news|user)", env=".*"}`,
+				"{news,user}.requests",
+				`(news|user).errors`,
+			},
+		},
+		{
+			name: "all option with the allValue of the template",
+			vars: RenderVars{
+				{Name: "ENV", Values: []Val{{Value: "$__all"}}},
+			},
+			expected: []string{
+				"$SERVICE_NAME",
+				`up{service=~"$SERVICE_NAME", env=".+"}`,
+				"$SERVICE_NAME.requests",
+				`$SERVICE_NAME.errors`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, renderMultiValue(t, tt.vars), tt.name)
+	}
+}
+
+func TestDefaultFormatter(t *testing.T) {
+	values := []string{"news", "pay'ment"}
+	tests := []struct {
+		datasource string
+		multi      string
+		single     string
+	}{
+		{"prometheus", `(news|pay\\'ment)`, `pay\\'ment`},
+		{"loki", `(news|pay\\'ment)`, `pay\\'ment`},
+		{"influxdb", `(news|pay'ment)`, `pay'ment`},
+		{"elasticsearch", `("news" OR "pay'ment")`, `pay'ment`},
+		{"mysql", `'news','pay''ment'`, `pay'ment`},
+		{"postgres", `'news','pay''ment'`, `pay'ment`},
+		{"graphite", `{news,pay'ment}`, `pay'ment`},
+		{"", `{news,pay'ment}`, `pay'ment`},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.multi, defaultFormatter(tt.datasource, true)("SERVICE_NAME", values, true), tt.datasource)
+		assert.Equal(t, tt.single, defaultFormatter(tt.datasource, false)("SERVICE_NAME", values[1:], false), tt.datasource)
+	}
+
+	// a set of one value is still a regex group in InfluxDB, but not in Prometheus
+	assert.Equal(t, "(news)", defaultFormatter("influxdb", true)("SERVICE_NAME", values[:1], true))
+	assert.Equal(t, "news", defaultFormatter("prometheus", true)("SERVICE_NAME", values[:1], true))
+}